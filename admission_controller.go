@@ -1,130 +1,164 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"mime"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/golang/glog"
 	v1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
 	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	"kubesphere.io/api/tenant/v1alpha1"
 )
 
-func mutateDeploy(svmate serverMate, deploy *appsv1.Deployment) *v1.AdmissionResponse {
-	var (
-		objectMeta, specMeta            *metav1.ObjectMeta
-		resourceName, resourceNamespace string
-	)
-	resourceName, resourceNamespace, objectMeta, specMeta = deploy.Name, deploy.Namespace, &deploy.ObjectMeta, &deploy.Spec.Template.ObjectMeta
+// pod模板中annotations的位置
+const (
+	templateAnnotationsPath = "/spec/template/metadata/annotations"
+	podAnnotationsPath      = "/metadata/annotations"
+)
 
-	var patches []patchOperation
+func mutateDeploy(svmate serverMate, deploy *appsv1.Deployment) *v1.AdmissionResponse {
+	return mutateFixedIPs(svmate, deploy.Name, deploy.Namespace, &deploy.ObjectMeta, &deploy.Spec.Template.ObjectMeta, templateAnnotationsPath, singleReplica(deploy.Spec.Replicas))
+}
 
-	//判断是否需要修改
-	if !admissionRequired(admissionWebhookAnnotationMutateKey, objectMeta) {
-		glog.Infof("Skipping validation for %s due to policy check", resourceName)
+// 只处理单独创建的ReplicaSet，Deployment和Rollout按pod模板查找自己的ReplicaSet，
+// 修改它们的ReplicaSet会让控制器不断创建新的ReplicaSet
+func mutateReplicaSet(svmate serverMate, rs *appsv1.ReplicaSet) *v1.AdmissionResponse {
+	if ownedByController(&rs.ObjectMeta, rs.Name) {
 		return &v1.AdmissionResponse{
 			Allowed: true,
 		}
 	}
+	return mutateFixedIPs(svmate, rs.Name, rs.Namespace, &rs.ObjectMeta, &rs.Spec.Template.ObjectMeta, templateAnnotationsPath, singleReplica(rs.Spec.Replicas))
+}
 
-	client := svmate.client
+// DaemonSet在每个节点上运行一个pod
+func mutateDaemonSet(svmate serverMate, ds *appsv1.DaemonSet) *v1.AdmissionResponse {
+	return mutateFixedIPs(svmate, ds.Name, ds.Namespace, &ds.ObjectMeta, &ds.Spec.Template.ObjectMeta, templateAnnotationsPath, false)
+}
 
-	//通过标签判断是否为网关deployment
-	if !checkKsIngress(objectMeta, resourceName) {
-		patchBytes, err := json.Marshal(patches)
-		if err != nil {
-			return &v1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
-		}
-		glog.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
+// 单独创建的pod，网关标签和固定ip都在pod自身的metadata上
+// 工作负载创建的pod从已经注入的模板继承固定ip
+// 只有generateName的pod在创建前没有名称，不能为它单独预留固定ip
+func mutatePod(svmate serverMate, pod *corev1.Pod) *v1.AdmissionResponse {
+	name := pod.Name
+	if name == "" {
+		name = pod.GenerateName
+	}
+	if ownedByController(&pod.ObjectMeta, name) {
 		return &v1.AdmissionResponse{
 			Allowed: true,
-			Patch:   patchBytes,
-			PatchType: func() *v1.PatchType {
-				pt := v1.PatchTypeJSONPatch
-				return &pt
-			}(),
 		}
 	}
+	return mutateFixedIPs(svmate, name, pod.Namespace, &pod.ObjectMeta, &pod.ObjectMeta, podAnnotationsPath, pod.Name != "")
+}
 
-	//获取所在子网的前15个ip地址，生成annotation键值对
-	subnet := client.getSubnet(resourceNamespace)
-	if subnet == "ERROR" {
-		msg := fmt.Sprintf("namespace: \"%v\" 没有关联到子网，请排查sdn网络", resourceNamespace)
-		glog.Errorf(msg)
-		return &v1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: msg,
-			},
-		}
+// 有controller ownerReference的对象由父对象的处理器注入固定ip
+func ownedByController(objectMeta *metav1.ObjectMeta, resourceName string) bool {
+	owner := metav1.GetControllerOf(objectMeta)
+	if owner == nil {
+		return false
 	}
-	ips := createAnnotation(subnet)
+	glog.Infof("%s由%s %s管理，跳过注入固定ip地址", resourceName, owner.Kind, owner.Name)
+	return true
+}
 
-	//ips := make(map[string]string)
-	//ips["nci.yunshan.net/ips"] = "10.64.88.1,10.64.88.2,10.64.88.3,10.64.88.4,10.64.88.5,10.64.88.6,10.64.88.7,10.64.88.8,10.64.88.9,10.64.88.10,10.64.88.11,10.64.88.12,10.64.88.13,10.64.88.14,10.64.88.15"
+// 未设置副本数时为1
+func singleReplica(replicas *int32) bool {
+	return replicas == nil || *replicas <= 1
+}
 
-	if !checkAnnotation(specMeta, ips) {
-		glog.Infof("%s已经注入了固定ip地址,", resourceName)
+// 为网关应用的pod模板注入固定ip，specMeta为pod模板的metadata，annotationsPath为其annotations的patch路径
+// singlePod表示模板只创建一个pod，sdn不允许多个pod共用固定ip时多副本的网关不注入
+// overrides是发布过程中会覆盖pod annotations的metadata，其中的固定ip同样改为子网的地址
+func mutateFixedIPs(svmate serverMate, resourceName, resourceNamespace string, objectMeta, specMeta *metav1.ObjectMeta, annotationsPath string, singlePod bool, overrides ...annotationOverride) *v1.AdmissionResponse {
+	var patches []patchOperation
 
-		patchBytes, err := json.Marshal(patches)
-		if err != nil {
-			return &v1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
-		}
-		glog.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
+	//判断是否需要修改
+	if !admissionRequired(admissionWebhookAnnotationMutateKey, objectMeta) {
+		glog.Infof("Skipping validation for %s due to policy check", resourceName)
 		return &v1.AdmissionResponse{
 			Allowed: true,
-			Patch:   patchBytes,
-			PatchType: func() *v1.PatchType {
-				pt := v1.PatchTypeJSONPatch
-				return &pt
-			}(),
 		}
 	}
 
-	patch := createPatch(specMeta.Annotations, ips)
+	client := svmate.client
 
-	for i := range patch {
-		patches = append(patches, patch[i])
+	//通过标签判断是否为网关deployment
+	if !checkKsIngress(objectMeta, resourceName) {
+		return patchResponse(svmate.locale, patches)
 	}
 
-	patchBytes, err := json.Marshal(patches)
+	//按WebhookPolicy判断是否注入固定ip
+	nsLabels, err := client.namespaceLabels(svmate.ctx, resourceNamespace)
 	if err != nil {
-		return &v1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
+		return denied(svmate.locale, transientError(err, msgNamespaceLookupFailed, resourceNamespace))
+	}
+	enabled, err := client.featureEnabled(svmate.ctx, featureFixedIPs, policySubject{
+		workspace:       nsLabels[admissionWebhookWorkspaceKey],
+		namespaceLabels: nsLabels,
+		objectLabels:    objectMeta.Labels,
+	})
+	if err != nil {
+		return denied(svmate.locale, transientError(err, msgPolicyLookupFailed))
+	}
+	if !enabled {
+		glog.Infof("%s的固定ip功能被WebhookPolicy关闭，跳过注入", resourceName)
+		return patchResponse(svmate.locale, patches)
+	}
+
+	//多个pod使用同一个地址会冲突，去掉扩容前注入的固定ip
+	backend := client.backend()
+	if !singlePod && !backend.sharedFixedIPs() {
+		glog.Warningf("%s有多个pod，不能共用固定ip，跳过注入", resourceName)
+		if _, ok := specMeta.Annotations[backend.fixedIPsKey()]; ok {
+			patches = append(patches, patchOperation{Op: "remove", Path: annotationsPath + "/" + escapeJSONPointer(backend.fixedIPsKey())})
 		}
+		return patchResponse(svmate.locale, patches)
 	}
 
-	glog.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
-	return &v1.AdmissionResponse{
-		Allowed: true,
-		Patch:   patchBytes,
-		PatchType: func() *v1.PatchType {
-			pt := v1.PatchTypeJSONPatch
-			return &pt
-		}(),
+	//获取所在子网的前15个ip地址，生成annotation键值对
+	subnet, err := client.getSubnet(svmate.ctx, resourceNamespace)
+	if err != nil {
+		return denied(svmate.locale, err)
+	}
+	ips, err := client.createAnnotation(svmate.ctx, subnet, gatewayRef{Kind: svmate.kind, Namespace: resourceNamespace, Name: resourceName}, svmate.dryRun)
+	if err != nil {
+		var admErr *admissionError
+		if !errors.As(err, &admErr) {
+			err = internalError(err, msgSubnetConvertFailed, resourceNamespace)
+		}
+		return denied(svmate.locale, err)
 	}
 
+	if checkAnnotation(specMeta, backend.fixedIPsKey(), ips) {
+		patches = append(patches, updateAnnotations(annotationsPath, specMeta.Annotations, ips)...)
+	} else {
+		glog.Infof("%s已经注入了固定ip地址,", resourceName)
+	}
+	for _, o := range overrides {
+		patches = append(patches, o.pin(backend.fixedIPsKey(), ips[backend.fixedIPsKey()])...)
+	}
+
+	return patchResponse(svmate.locale, patches)
+
 }
 
 func mutateNamespce(svmate serverMate, namespace *corev1.Namespace) *v1.AdmissionResponse {
@@ -144,56 +178,52 @@ func mutateNamespce(svmate serverMate, namespace *corev1.Namespace) *v1.Admissio
 		}
 	}
 
-	addLabels := make(map[string]string)
-
-	var workspace string
+	//namespaceValidator已经检查过业务空间
+	workspace := objectMeta.Labels[admissionWebhookWorkspaceKey]
 
-	//判断有没有workspace标签
-	if _, ok := objectMeta.Labels[admissionWebhookWorkspaceKey]; !ok {
-		msg := fmt.Sprintf("Invalid namespace: \"%v\" not in workspace", objectMeta.Name)
-		glog.Errorf(msg)
+	//按WebhookPolicy判断是否打vpc标签
+	enabled, err := client.featureEnabled(svmate.ctx, featureVpcLabel, policySubject{
+		workspace:       workspace,
+		namespaceLabels: objectMeta.Labels,
+		objectLabels:    objectMeta.Labels,
+	})
+	if err != nil {
+		return denied(svmate.locale, transientError(err, msgPolicyLookupFailed))
+	}
+	if !enabled {
+		glog.Infof("%s的vpc标签功能被WebhookPolicy关闭", resourceName)
 		return &v1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: msg,
-			},
+			Allowed: true,
 		}
-	} else {
-		workspace = objectMeta.Labels[admissionWebhookWorkspaceKey]
 	}
 
-	//判断workspace是否存在
-	if !client.workspaceExist(workspace) {
-		msg := fmt.Sprintf("业务空间: \"%v\" 不存在", workspace)
-		glog.Errorf(msg)
-		return &v1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: msg,
-			},
+	//生成vpc名，namespaceValidator已经检查过指定的vpc
+	backend := client.backend()
+	vpcName := namespaceVpcName(objectMeta, workspace, svmate)
+
+	//Kube-OVN需要把namespace登记到vpc，dryRun的请求不修改vpc
+	if membership, ok := backend.(vpcMembership); ok && !svmate.dryRun {
+		if err := membership.joinVpc(svmate.ctx, client.dynamicClient, vpcName, resourceName); err != nil {
+			return denied(svmate.locale, transientError(err, msgVpcJoinFailed, resourceName, vpcName))
 		}
 	}
-	//生成vpc名
-	if svmate.vpcprefix == "default" {
-		addLabels[admissionWebhookLabelsKey] = "default"
-	} else {
-		addLabels[admissionWebhookLabelsKey] = generateVpcName(workspace, svmate)
-	}
 
-	if !checkLabel(objectMeta, addLabels[admissionWebhookLabelsKey]) {
+	pathes := backend.bindNamespace(objectMeta, vpcName)
+	if len(pathes) == 0 {
 		glog.Infof("Skipping validation for %s due to policy check", resourceName)
 		return &v1.AdmissionResponse{
 			Allowed: true,
 		}
 	}
 
-	pathes := createPatch(objectMeta.Labels, addLabels)
+	return patchResponse(svmate.locale, pathes)
+}
 
-	patchBytes, err := json.Marshal(pathes)
+// 返回带JSONPatch的AdmissionResponse
+func patchResponse(loc locale, patches []patchOperation) *v1.AdmissionResponse {
+	patchBytes, err := json.Marshal(patches)
 	if err != nil {
-		return &v1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
+		return denied(loc, internalError(err, msgPatchMarshalFailed))
 	}
 
 	glog.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
@@ -213,6 +243,7 @@ func init() {
 	// defaulting with webhooks:
 	// https://github.com/kubernetes/kubernetes/issues/57982
 	_ = v1.AddToScheme(runtimeScheme)
+	_ = v1beta1.AddToScheme(runtimeScheme)
 }
 
 func admissionRequired(admissionWebhookAnnotationMutateKey string, metadata *metav1.ObjectMeta) bool {
@@ -257,7 +288,7 @@ func checkKsIngress(metaData *metav1.ObjectMeta, resourceName string) bool {
 	return true
 }
 
-func checkLabel(metaData *metav1.ObjectMeta, targetLabel string) bool {
+func checkLabel(metaData *metav1.ObjectMeta, labelKey, targetLabel string) bool {
 
 	required := true
 	labels := metaData.GetLabels()
@@ -266,8 +297,8 @@ func checkLabel(metaData *metav1.ObjectMeta, targetLabel string) bool {
 	}
 
 	//检查标签是否已经存在
-	if _, ok := labels[admissionWebhookLabelsKey]; ok {
-		if labels[admissionWebhookLabelsKey] == targetLabel {
+	if _, ok := labels[labelKey]; ok {
+		if labels[labelKey] == targetLabel {
 			required = false
 		}
 
@@ -277,6 +308,17 @@ func checkLabel(metaData *metav1.ObjectMeta, targetLabel string) bool {
 	return required
 }
 
+// namespace应该绑定的vpc：指定的vpc或者业务空间的vpc
+func namespaceVpcName(objectMeta *metav1.ObjectMeta, workspace string, svmate serverMate) string {
+	if vpc, ok := vpcOverride(objectMeta); ok {
+		return vpc
+	}
+	if svmate.vpcprefix == "default" {
+		return svmate.client.backend().defaultVpc()
+	}
+	return generateVpcName(workspace, svmate)
+}
+
 func generateVpcName(workspace string, svmate serverMate) string {
 	ws := make(map[string]bool)
 	var vpcName string
@@ -298,9 +340,9 @@ func generateVpcName(workspace string, svmate serverMate) string {
 	} else {
 		switch workspace {
 		case "system-workspace":
-			vpcName = "default"
+			vpcName = svmate.client.backend().defaultVpc()
 		case "firefly":
-			vpcName = "default"
+			vpcName = svmate.client.backend().defaultVpc()
 		default:
 			labelValue := []string{svmate.vpcprefix, workspace}
 			vpcName = strings.Join(labelValue, "-")
@@ -310,7 +352,7 @@ func generateVpcName(workspace string, svmate serverMate) string {
 	return vpcName
 }
 
-func checkAnnotation(meta *metav1.ObjectMeta, targetAnnotation map[string]string) bool {
+func checkAnnotation(meta *metav1.ObjectMeta, annotationKey string, targetAnnotation map[string]string) bool {
 
 	required := true
 	annotations := meta.Annotations
@@ -319,8 +361,8 @@ func checkAnnotation(meta *metav1.ObjectMeta, targetAnnotation map[string]string
 	}
 
 	//检查描述是否存在
-	if _, ok := annotations[admissionWebhookAnnotationsKey]; ok {
-		if annotations[admissionWebhookAnnotationsKey] == targetAnnotation[admissionWebhookAnnotationsKey] {
+	if _, ok := annotations[annotationKey]; ok {
+		if annotations[annotationKey] == targetAnnotation[annotationKey] {
 			required = false
 		}
 
@@ -348,7 +390,7 @@ func updateLabels(target map[string]string, added map[string]string) (patch []pa
 	return patch
 }
 
-func updateAnnotations(target map[string]string, added map[string]string) (patch []patchOperation) {
+func updateAnnotations(path string, target map[string]string, added map[string]string) (patch []patchOperation) {
 	values := make(map[string]string)
 	if len(target) > 0 {
 		values = target
@@ -360,170 +402,350 @@ func updateAnnotations(target map[string]string, added map[string]string) (patch
 
 	patch = append(patch, patchOperation{
 		Op:    "add",
-		Path:  "/spec/template/metadata/annotations",
+		Path:  path,
 		Value: values,
 	})
 	return patch
 }
 
-func createPatch(availableKeys map[string]string, values map[string]string) []patchOperation {
-	var patch []patchOperation
-
-	if _, ok := values["nci.yunshan.net/ips"]; ok {
-		patch = append(patch, updateAnnotations(availableKeys, values)...)
-	} else {
-		patch = append(patch, updateLabels(availableKeys, values)...)
-	}
-	return patch
+// main mutation process
+func (whsvr *WebhookServer) mutate(ctx context.Context, ar *v1.AdmissionReview, loc locale) *v1.AdmissionResponse {
+	return whsvr.admit(ctx, ar, loc, "")
 }
 
-// main mutation process
-func (whsvr *WebhookServer) mutate(ar *v1.AdmissionReview) *v1.AdmissionResponse {
+// route为处理器单独的路径，只接受该处理器的资源，为空时按请求的资源查找处理器
+func (whsvr *WebhookServer) admit(ctx context.Context, ar *v1.AdmissionReview, loc locale, route string) *v1.AdmissionResponse {
 	req := ar.Request
 	var svmate serverMate
+	svmate.ctx = ctx
 	svmate.vpcprefix, svmate.cluster, svmate.abnormalws, svmate.op = whsvr.vpcprefix, whsvr.cluster, whsvr.abnormalws, req.Operation
+	svmate.locale = loc
+	svmate.kind = req.Kind.Kind
+	svmate.dryRun = req.DryRun != nil && *req.DryRun
 
-	// 实例化 DynamicClient
-	config, err := clientcmd.BuildConfigFromFlags("", "")
-	if err != nil {
-		panic(err.Error())
-	}
-
-	svmate.client.dynamicClient, err = dynamic.NewForConfig(config)
-	if err != nil {
-		panic(err.Error())
-	}
+	svmate.client = whsvr.client
+	svmate.vpcTemplates = whsvr.vpcTemplates
+	svmate.vpcOverride = whsvr.vpcOverride
 
 	glog.Infof("AdmissionReview for Kind=%v, Name=%v UID=%v patchOperation=%v UserInfo=%v",
 		req.Kind, req.Name, req.UID, req.Operation, req.UserInfo)
-	switch req.Kind.Kind {
-	case "Namespace":
-		var namespace corev1.Namespace
 
-		if err := json.Unmarshal(req.Object.Raw, &namespace); err != nil {
-			glog.Errorf("Could not unmarshal raw object: %v", err)
-			return &v1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
+	gvk := schema.GroupVersionKind{Group: req.Kind.Group, Version: req.Kind.Version, Kind: req.Kind.Kind}
+	h, ok := lookupHandler(gvk, req.Operation)
+	if !ok || (route != "" && h.path() != route) {
+		return whsvr.unregistered(req, loc)
+	}
+
+	//被关闭的处理器直接放行
+	if !handlerEnabled(h, whsvr.features, whsvr.handlers) {
+		glog.Infof("Handler %s is disabled, skipping %s", h.gvr.Resource, req.Kind.Kind)
+		return &v1.AdmissionResponse{
+			Allowed: true,
 		}
-		glog.Infof("start mutateNamespce")
-		return mutateNamespce(svmate, &namespace)
-	case "Deployment":
-		var deployment appsv1.Deployment
-		if err := json.Unmarshal(req.Object.Raw, &deployment); err != nil {
-			glog.Errorf("Could not unmarshal raw object: %v", err)
-			return &v1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
+	}
+
+	if h.validator != nil {
+		if err := h.validator.validate(svmate, req); err != nil {
+			return whsvr.applyFailureMode(h.kind, denied(loc, err), loc)
 		}
-		glog.Infof("start mutateDeploy")
-		return mutateDeploy(svmate, &deployment)
-	case "Workspace":
-		glog.Infof("start vpcHandler")
-		return vpcHandler(req.Name, svmate)
-	default:
-		msg := fmt.Sprintf("\nNot support for this Kind of resource  %v", req.Kind.Kind)
-		glog.Infof(msg)
+	}
+	return whsvr.applyFailureMode(h.kind, h.mutator.mutate(svmate, req), loc)
+}
+
+// 没有注册处理器的资源和操作按-unregistered-kinds放行或拒绝
+func (whsvr *WebhookServer) unregistered(req *v1.AdmissionRequest, loc locale) *v1.AdmissionResponse {
+	if whsvr.unregisteredKinds == failureModeAllow {
+		glog.Infof("No handler for %v %v, allowing", req.Kind, req.Operation)
 		return &v1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: msg,
-			},
+			Allowed: true,
 		}
 	}
+	return denied(loc, badRequest(msgUnsupportedKind, req.Kind.Kind))
+}
+
+// 解析请求中的对象
+func decodeObject(req *v1.AdmissionRequest, obj interface{}) error {
+	if err := json.Unmarshal(req.Object.Raw, obj); err != nil {
+		glog.Errorf("Could not unmarshal raw object: %v", err)
+		return badRequest(msgObjectDecodeFailed, err)
+	}
+	return nil
+}
+
+// namespace必须属于一个存在的业务空间
+var namespaceValidator = validatorFunc(func(svmate serverMate, req *v1.AdmissionRequest) error {
+	var namespace corev1.Namespace
+	if err := decodeObject(req, &namespace); err != nil {
+		return err
+	}
+	if !admissionRequired(admissionWebhookAnnotationMutateKey, &namespace.ObjectMeta) {
+		//不修改的namespace只能沿用原来的vpc或者使用业务空间的vpc，指定vpc的annotation不会生效
+		expected := ""
+		if workspace := namespace.Labels[admissionWebhookWorkspaceKey]; workspace != "" {
+			expected = namespaceVpcName(&metav1.ObjectMeta{}, workspace, svmate)
+		}
+		return svmate.vpcOverride.authorizeBinding(req, &namespace, svmate.client.backend(), expected)
+	}
+
+	//判断有没有workspace标签
+	workspace, ok := namespace.Labels[admissionWebhookWorkspaceKey]
+	if !ok {
+		return policyViolation(msgNotInWorkspace, namespace.Name)
+	}
+
+	//判断workspace是否存在
+	exist, err := svmate.client.workspaceExist(svmate.ctx, workspace)
+	if err != nil {
+		return transientError(err, msgWorkspaceLookupFailed, workspace)
+	}
+	if !exist {
+		return missingDependency("workspaces", workspace, msgWorkspaceNotFound, workspace)
+	}
+
+	//指定vpc需要管理员组，并且vpc在允许的列表中
+	if err := svmate.vpcOverride.authorize(req, &namespace); err != nil {
+		return err
+	}
+
+	//vpc标签开启时mutator会把绑定改为计算出的vpc，不需要检查
+	enabled, err := svmate.client.featureEnabled(svmate.ctx, featureVpcLabel, policySubject{
+		workspace:       workspace,
+		namespaceLabels: namespace.Labels,
+		objectLabels:    namespace.Labels,
+	})
+	if err != nil {
+		return transientError(err, msgPolicyLookupFailed)
+	}
+	if enabled {
+		return nil
+	}
+
+	//WebhookPolicy关闭vpc标签时不会覆盖绑定，非管理员不能自行绑定到其他vpc
+	return svmate.vpcOverride.authorizeBinding(req, &namespace, svmate.client.backend(), namespaceVpcName(&namespace.ObjectMeta, workspace, svmate))
+})
+
+var namespaceMutator = mutatorFunc(func(svmate serverMate, req *v1.AdmissionRequest) *v1.AdmissionResponse {
+	var namespace corev1.Namespace
+	if err := decodeObject(req, &namespace); err != nil {
+		return denied(svmate.locale, err)
+	}
+	glog.Infof("start mutateNamespce")
+	return mutateNamespce(svmate, &namespace)
+})
+
+var deploymentMutator = mutatorFunc(func(svmate serverMate, req *v1.AdmissionRequest) *v1.AdmissionResponse {
+	var deployment appsv1.Deployment
+	if err := decodeObject(req, &deployment); err != nil {
+		return denied(svmate.locale, err)
+	}
+	glog.Infof("start mutateDeploy")
+	return mutateDeploy(svmate, &deployment)
+})
+
+var replicaSetMutator = mutatorFunc(func(svmate serverMate, req *v1.AdmissionRequest) *v1.AdmissionResponse {
+	var rs appsv1.ReplicaSet
+	if err := decodeObject(req, &rs); err != nil {
+		return denied(svmate.locale, err)
+	}
+	glog.Infof("start mutateReplicaSet")
+	return mutateReplicaSet(svmate, &rs)
+})
+
+var daemonSetMutator = mutatorFunc(func(svmate serverMate, req *v1.AdmissionRequest) *v1.AdmissionResponse {
+	var ds appsv1.DaemonSet
+	if err := decodeObject(req, &ds); err != nil {
+		return denied(svmate.locale, err)
+	}
+	glog.Infof("start mutateDaemonSet")
+	return mutateDaemonSet(svmate, &ds)
+})
+
+var podMutator = mutatorFunc(func(svmate serverMate, req *v1.AdmissionRequest) *v1.AdmissionResponse {
+	var pod corev1.Pod
+	if err := decodeObject(req, &pod); err != nil {
+		return denied(svmate.locale, err)
+	}
+	glog.Infof("start mutatePod")
+	return mutatePod(svmate, &pod)
+})
+
+var serviceMutator = mutatorFunc(func(svmate serverMate, req *v1.AdmissionRequest) *v1.AdmissionResponse {
+	var svc corev1.Service
+	if err := decodeObject(req, &svc); err != nil {
+		return denied(svmate.locale, err)
+	}
+	glog.Infof("start mutateService")
+	return mutateService(svmate, &svc)
+})
+
+var templateWorkloadMutator = mutatorFunc(func(svmate serverMate, req *v1.AdmissionRequest) *v1.AdmissionResponse {
+	var workload unstructured.Unstructured
+	if err := workload.UnmarshalJSON(req.Object.Raw); err != nil {
+		glog.Errorf("Could not unmarshal raw object: %v", err)
+		return denied(svmate.locale, badRequest(msgObjectDecodeFailed, err))
+	}
+	glog.Infof("start mutateTemplateWorkload")
+	return mutateTemplateWorkload(svmate, &workload)
+})
+
+var workspaceMutator = mutatorFunc(func(svmate serverMate, req *v1.AdmissionRequest) *v1.AdmissionResponse {
+	// 删除时请求中只有oldObject
+	raw := req.Object.Raw
+	if len(raw) == 0 {
+		raw = req.OldObject.Raw
+	}
+	var workspace unstructured.Unstructured
+	if len(raw) > 0 {
+		if err := workspace.UnmarshalJSON(raw); err != nil {
+			glog.Errorf("Could not unmarshal raw object: %v", err)
+			return denied(svmate.locale, badRequest(msgObjectDecodeFailed, err))
+		}
+	}
+	glog.Infof("start vpcHandler")
+	return vpcHandler(req.Name, &workspace, svmate)
+})
+
+// 注册/mutate以及每个处理器单独的路径
+func (whsvr *WebhookServer) registerRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/mutate", whsvr.serve)
+	for _, h := range admissionHandlers {
+		mux.HandleFunc(h.path(), whsvr.serve)
+	}
+}
 
+// AdmissionReview的大小上限，apiserver中单个对象不超过3MiB，请求中最多包含object和oldObject
+const maxAdmissionReviewBytes = 7 << 20
+
+// 放回池中的buffer上限，避免偶尔的大请求长期占用内存
+const maxPooledBufferBytes = 1 << 20
+
+// 读取请求和编码响应使用的buffer
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBufferBytes {
+		bufferPool.Put(buf)
+	}
 }
 
 // Serve method for webhook server
+// 先检查方法和Content-Type，限制大小读取请求体，使用共享的scheme只解码一次
 func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
-	var body []byte
-
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	// verify the content type is accurate
+	contentType := r.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
+		glog.Errorf("Content-Type=%s, expect application/json", contentType)
+		http.Error(w, "invalid Content-Type, expect `application/json`", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body := getBuffer()
+	defer putBuffer(body)
 	if r.Body != nil {
-		if data, err := ioutil.ReadAll(r.Body); err == nil {
-			body = data
+		if _, err := body.ReadFrom(http.MaxBytesReader(w, r.Body, maxAdmissionReviewBytes)); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				glog.Errorf("Request body exceeds %d bytes", tooLarge.Limit)
+				http.Error(w, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+				return
+			}
+			glog.Errorf("Can't read body: %v", err)
+			http.Error(w, fmt.Sprintf("could not read body: %v", err), http.StatusBadRequest)
+			return
 		}
 	}
-	if len(body) == 0 {
+	if body.Len() == 0 {
 		glog.Error("empty body")
 		http.Error(w, "empty body", http.StatusBadRequest)
 		return
 	}
 
-	var admission v1.AdmissionReview
-	codefc := serializer.NewCodecFactory(runtime.NewScheme())
-	decoder := codefc.UniversalDeserializer()
-	_, _, err := decoder.Decode(body, nil, &admission)
-
+	// 兼容admission.k8s.io/v1beta1，按请求的版本返回
+	obj, gvk, err := deserializer.Decode(body.Bytes(), nil, nil)
+	var ar *v1.AdmissionReview
+	if err == nil {
+		ar, err = admissionReviewFromObject(obj)
+	}
 	if err != nil {
 		msg := fmt.Sprintf("Request could not be decoded: %v", err)
 		glog.Error(msg)
 		http.Error(w, msg, http.StatusBadRequest)
 		return
 	}
-
-	if admission.Request == nil {
-		glog.Error(fmt.Sprintf("admission review can't be used: Request field is nil"))
-		http.Error(w, fmt.Errorf("admission review can't be used: Request field is nil").Error(), http.StatusBadRequest)
+	if ar.Request == nil {
+		glog.Error("admission review can't be used: Request field is nil")
+		http.Error(w, "admission review can't be used: Request field is nil", http.StatusBadRequest)
 		return
 	}
 
-	// verify the content type is accurate
-	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/json" {
-		glog.Errorf("Content-Type=%s, expect application/json", contentType)
-		http.Error(w, "invalid Content-Type, expect `application/json`", http.StatusUnsupportedMediaType)
-		return
-	}
+	// 提示信息的语言，优先使用请求中的Accept-Language
+	loc := negotiateLocale(r.Header.Get("Accept-Language"), whsvr.locale)
 
 	var admissionResponse *v1.AdmissionResponse
-	ar := v1.AdmissionReview{}
-	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
-		glog.Errorf("Can't decode body: %v", err)
-		admissionResponse = &v1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
+	if release, limit := whsvr.limiter.acquire(); limit != "" {
+		// 超过限制按依赖不可用处理，由failure-mode决定放行还是拒绝
+		admissionResponse = whsvr.applyFailureMode(ar.Request.Kind.Kind, denied(loc, transientError(nil, msgOverloaded, limit)), loc)
 	} else {
-		if r.URL.Path == "/mutate" {
-			admissionResponse = whsvr.mutate(&ar)
+		defer release()
+		route := r.URL.Path
+		if route == "/mutate" {
+			route = ""
 		}
+		ctx, cancel := whsvr.requestContext(r)
+		defer cancel()
+		admissionResponse = whsvr.admit(ctx, ar, loc, route)
 	}
 
-	admissionReview := v1.AdmissionReview{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       admission.Kind,
-			APIVersion: admission.APIVersion,
-		},
-	}
-	if admissionResponse != nil {
-		admissionReview.Response = admissionResponse
-		if ar.Request != nil {
-			admissionReview.Response.UID = ar.Request.UID
-		}
-	}
+	admissionReview := admissionReviewForVersion(gvk.GroupVersion().String(), ar.Request.UID, admissionResponse)
 
-	resp, err := json.Marshal(admissionReview)
-	if err != nil {
+	resp := getBuffer()
+	defer putBuffer(resp)
+	if err := json.NewEncoder(resp).Encode(admissionReview); err != nil {
 		glog.Errorf("Can't encode response: %v", err)
 		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
 	}
 	glog.Infof("Ready to write reponse ...")
-	if _, err := w.Write(resp); err != nil {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp.Bytes()); err != nil {
 		glog.Errorf("Can't write response: %v", err)
-		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
 	}
 }
 
-func (c *Client) workspaceExist(workspaceName string) bool {
+// 实例化 DynamicClient，集群外运行时使用kubeconfig
+func newClient(kubeconfig string) (Client, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return Client{}, err
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return Client{}, err
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return Client{}, err
+	}
+
+	return Client{dynamicClient: dynamicClient, kubeClient: kubeClient}, nil
+}
+
+func (c *Client) workspaceExist(ctx context.Context, workspaceName string) (bool, error) {
 
 	// 设置要请求的 GVR
 	gvr := schema.GroupVersionResource{
@@ -533,10 +755,13 @@ func (c *Client) workspaceExist(workspaceName string) bool {
 	}
 
 	// 发送请求，并得到返回结果
-	unStructData, err := c.dynamicClient.Resource(gvr).Get(context.TODO(), workspaceName, metav1.GetOptions{})
+	unStructData, err := c.dynamicClient.Resource(gvr).Get(ctx, workspaceName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
 	if err != nil {
 		glog.Error(err.Error())
-		return false
+		return false, err
 	}
 
 	var obj v1alpha1.Workspace
@@ -549,5 +774,5 @@ func (c *Client) workspaceExist(workspaceName string) bool {
 
 	}
 
-	return true
+	return true, nil
 }
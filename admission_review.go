@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// 将解码后的AdmissionReview统一转换为v1版本，handler只处理v1的请求
+func admissionReviewFromObject(obj runtime.Object) (*v1.AdmissionReview, error) {
+	switch review := obj.(type) {
+	case *v1.AdmissionReview:
+		return review, nil
+	case *v1beta1.AdmissionReview:
+		ar := &v1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{
+				Kind:       "AdmissionReview",
+				APIVersion: v1.SchemeGroupVersion.String(),
+			},
+		}
+		if review.Request != nil {
+			ar.Request = requestFromV1beta1(review.Request)
+		}
+		return ar, nil
+	default:
+		return nil, fmt.Errorf("unsupported admission review type %T", obj)
+	}
+}
+
+// 按照请求的版本组装返回的AdmissionReview
+func admissionReviewForVersion(apiVersion string, uid types.UID, resp *v1.AdmissionResponse) runtime.Object {
+	if apiVersion == v1beta1.SchemeGroupVersion.String() {
+		review := &v1beta1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{
+				Kind:       "AdmissionReview",
+				APIVersion: apiVersion,
+			},
+		}
+		if resp != nil {
+			review.Response = responseToV1beta1(resp)
+			review.Response.UID = uid
+		}
+		return review
+	}
+
+	review := &v1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "AdmissionReview",
+			APIVersion: v1.SchemeGroupVersion.String(),
+		},
+	}
+	if resp != nil {
+		review.Response = resp
+		review.Response.UID = uid
+	}
+	return review
+}
+
+func requestFromV1beta1(req *v1beta1.AdmissionRequest) *v1.AdmissionRequest {
+	return &v1.AdmissionRequest{
+		UID:                req.UID,
+		Kind:               req.Kind,
+		Resource:           req.Resource,
+		SubResource:        req.SubResource,
+		RequestKind:        req.RequestKind,
+		RequestResource:    req.RequestResource,
+		RequestSubResource: req.RequestSubResource,
+		Name:               req.Name,
+		Namespace:          req.Namespace,
+		Operation:          v1.Operation(req.Operation),
+		UserInfo:           req.UserInfo,
+		Object:             req.Object,
+		OldObject:          req.OldObject,
+		DryRun:             req.DryRun,
+		Options:            req.Options,
+	}
+}
+
+func responseToV1beta1(resp *v1.AdmissionResponse) *v1beta1.AdmissionResponse {
+	out := &v1beta1.AdmissionResponse{
+		UID:              resp.UID,
+		Allowed:          resp.Allowed,
+		Result:           resp.Result,
+		Patch:            resp.Patch,
+		AuditAnnotations: resp.AuditAnnotations,
+		Warnings:         resp.Warnings,
+	}
+	if resp.PatchType != nil {
+		pt := v1beta1.PatchType(*resp.PatchType)
+		out.PatchType = &pt
+	}
+	return out
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	v1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// v1beta1的请求转换为v1交给handler处理，响应按v1beta1返回
+func TestAdmissionReviewV1beta1RoundTrip(t *testing.T) {
+	obj, gvk, err := deserializer.Decode([]byte(`{
+  "kind": "AdmissionReview",
+  "apiVersion": "admission.k8s.io/v1beta1",
+  "request": {
+    "uid": "uid-leo",
+    "kind": {"group": "", "version": "v1", "kind": "Namespace"},
+    "resource": {"group": "", "version": "v1", "resource": "namespaces"},
+    "name": "leo",
+    "operation": "CREATE",
+    "userInfo": {"username": "admin"},
+    "object": {"apiVersion": "v1", "kind": "Namespace", "metadata": {"name": "leo"}}
+  }
+}`), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gvk.GroupVersion() != v1beta1.SchemeGroupVersion {
+		t.Fatalf("decoded as %s", gvk)
+	}
+
+	ar, err := admissionReviewFromObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := ar.Request
+	if req == nil || req.UID != "uid-leo" || req.Name != "leo" || req.Operation != v1.Create || req.Kind.Kind != "Namespace" || req.UserInfo.Username != "admin" || len(req.Object.Raw) == 0 {
+		t.Fatalf("unexpected request %+v", req)
+	}
+
+	patchType := v1.PatchTypeJSONPatch
+	review := admissionReviewForVersion(gvk.GroupVersion().String(), req.UID, &v1.AdmissionResponse{
+		Allowed:   true,
+		Patch:     []byte(`[]`),
+		PatchType: &patchType,
+	})
+	beta, ok := review.(*v1beta1.AdmissionReview)
+	if !ok {
+		t.Fatalf("answered with %T", review)
+	}
+	if beta.APIVersion != "admission.k8s.io/v1beta1" || beta.Response.UID != "uid-leo" || !beta.Response.Allowed {
+		t.Errorf("unexpected response %+v", beta)
+	}
+	if beta.Response.PatchType == nil || *beta.Response.PatchType != v1beta1.PatchTypeJSONPatch {
+		t.Errorf("unexpected patch type %v", beta.Response.PatchType)
+	}
+}
+
+func TestAdmissionReviewV1(t *testing.T) {
+	review := admissionReviewForVersion(v1.SchemeGroupVersion.String(), types.UID("uid-v1"), &v1.AdmissionResponse{Allowed: true})
+	data, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out v1.AdmissionReview
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.APIVersion != "admission.k8s.io/v1" || out.Response == nil || out.Response.UID != "uid-v1" {
+		t.Errorf("unexpected review %s", data)
+	}
+
+	if _, err := admissionReviewFromObject(&corev1.Namespace{}); err == nil {
+		t.Error("expected an error for an object that is not an AdmissionReview")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// 网络资源回收的审计记录，每条一行JSON
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Resource  string    `json:"resource"` // subnet或fixedIPs
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name,omitempty"`
+	VPC       string    `json:"vpc,omitempty"`
+	CIDR      string    `json:"cidr,omitempty"`
+	IPs       string    `json:"ips,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// 审计记录追加写入文件，未配置文件时写入日志
+type auditLogger struct {
+	mu   sync.Mutex
+	file *os.File
+	now  func() time.Time
+}
+
+func newAuditLogger(path string) (*auditLogger, error) {
+	logger := &auditLogger{now: time.Now}
+	if path == "" {
+		return logger, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	logger.file = file
+	return logger, nil
+}
+
+func (l *auditLogger) record(entry auditEntry) {
+	entry.Time = l.now().UTC()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		glog.Errorf("Failed to marshal audit entry: %v", err)
+		return
+	}
+
+	if l.file == nil {
+		glog.Infof("AUDIT %s", data)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		glog.Errorf("Failed to write audit entry %s: %v", data, err)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	v1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// backfill子命令的参数
+type backfillParameters struct {
+	kubeconfig string
+	vpcprefix  string
+	cluster    string
+	workspaces sliceFlag // 不规范命名的业务空间，与webhook的-ws一致
+	scope      sliceFlag // 只处理这些业务空间下的namespace，为空时处理所有业务空间
+	features   sliceFlag
+	locale     string
+	dryRun     bool
+	qps        float64 // 每秒处理的对象数
+	burst      int
+	sdn        string
+}
+
+// 对已经存在的namespace和网关deployment补打webhook会生成的vpc标签和固定ip
+func runBackfill(args []string) int {
+	var parameters backfillParameters
+
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	fs.StringVar(&parameters.kubeconfig, "kubeconfig", "", "Path to a kubeconfig. Only required if out-of-cluster.")
+	fs.StringVar(&parameters.vpcprefix, "vpcprefix", "default", "vpcprefix")
+	fs.StringVar(&parameters.cluster, "cluster", "poc", "cluster")
+	fs.Var(&parameters.workspaces, "ws", "abnormal workspaces,for example:shanlv,tuangou")
+	fs.Var(&parameters.scope, "workspace", "Only backfill namespaces of these workspaces. Empty covers every workspace.")
+	parameters.features = sliceFlag{string(featureVpcLabel), string(featureFixedIPs)}
+	fs.Var(&parameters.features, "features", "Patches to apply: vpcLabel,fixedIPs")
+	fs.StringVar(&parameters.locale, "locale", "zh", "Locale of user-facing messages: zh or en.")
+	fs.BoolVar(&parameters.dryRun, "dry-run", false, "Print the patches without applying them.")
+	fs.Float64Var(&parameters.qps, "qps", 5, "Objects checked per second.")
+	fs.IntVar(&parameters.burst, "burst", 10, "Objects checked in a burst above -qps.")
+	fs.StringVar(&parameters.sdn, "sdn", "yunshan", "SDN backing VPCs and subnets: yunshan, kube-ovn or calico.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	loc, ok := parseLocale(parameters.locale)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "backfill: unsupported locale %q\n", parameters.locale)
+		return 2
+	}
+	if parameters.qps <= 0 || parameters.burst <= 0 {
+		fmt.Fprintln(os.Stderr, "backfill: -qps and -burst must be positive")
+		return 2
+	}
+
+	backend, err := sdnBackendByName(parameters.sdn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backfill: %v\n", err)
+		return 2
+	}
+
+	client, err := newClient(parameters.kubeconfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backfill: %v\n", err)
+		return 1
+	}
+	client.sdn = backend
+	whsvr := &WebhookServer{
+		vpcprefix:  parameters.vpcprefix,
+		abnormalws: parameters.workspaces,
+		cluster:    parameters.cluster,
+		locale:     loc,
+		features:   parameters.features,
+		client:     client,
+	}
+
+	b := &backfiller{
+		whsvr:   whsvr,
+		scope:   parameters.scope,
+		dryRun:  parameters.dryRun,
+		limiter: flowcontrol.NewTokenBucketRateLimiter(float32(parameters.qps), parameters.burst),
+		out:     os.Stdout,
+	}
+	summary, err := b.run(context.Background())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backfill: %v\n", err)
+		return 1
+	}
+	if summary.failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+type backfillSummary struct {
+	patched, unchanged, skipped, failed int
+}
+
+// 通过与webhook相同的mutate流程计算patch，再以JSON patch写回集群
+type backfiller struct {
+	whsvr   *WebhookServer
+	scope   sliceFlag
+	dryRun  bool
+	limiter flowcontrol.RateLimiter
+	out     io.Writer
+}
+
+func (b *backfiller) run(ctx context.Context) (backfillSummary, error) {
+	var summary backfillSummary
+
+	client := b.whsvr.client.dynamicClient
+	namespaces, err := client.Resource(namespaceGVR).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return summary, fmt.Errorf("list namespaces: %v", err)
+	}
+
+	// 只处理属于业务空间的namespace，先补namespace的标签再处理其中的deployment
+	for i := range namespaces.Items {
+		ns := &namespaces.Items[i]
+		workspace, ok := ns.GetLabels()[admissionWebhookWorkspaceKey]
+		if !ok || (len(b.scope) > 0 && !b.scope.has(workspace)) {
+			continue
+		}
+		if err := b.apply(ctx, "Namespace", namespaceGVR, ns, &summary); err != nil {
+			return summary, err
+		}
+
+		deployments, err := client.Resource(deploymentGVR).Namespace(ns.GetName()).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return summary, fmt.Errorf("list deployments of %s: %v", ns.GetName(), err)
+		}
+		for j := range deployments.Items {
+			if err := b.apply(ctx, "Deployment", deploymentGVR, &deployments.Items[j], &summary); err != nil {
+				return summary, err
+			}
+		}
+	}
+
+	verb := "patched"
+	if b.dryRun {
+		verb = "would patch"
+	}
+	fmt.Fprintf(b.out, "%d %s, %d unchanged, %d skipped, %d failed\n", summary.patched, verb, summary.unchanged, summary.skipped, summary.failed)
+	return summary, nil
+}
+
+// 单个对象的失败只计数，ctx取消时返回错误
+func (b *backfiller) apply(ctx context.Context, kind string, gvr schema.GroupVersionResource, obj *unstructured.Unstructured, summary *backfillSummary) error {
+	if err := b.limiter.Wait(ctx); err != nil {
+		return err
+	}
+
+	name := obj.GetName()
+	if obj.GetNamespace() != "" {
+		name = obj.GetNamespace() + "/" + name
+	}
+
+	raw, err := obj.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	ar := backfillReview(kind, gvr, obj, raw)
+	// dry-run时不为网关预留固定ip
+	ar.Request.DryRun = &b.dryRun
+	resp := b.whsvr.mutate(ctx, ar, b.whsvr.locale)
+
+	switch {
+	case !resp.Allowed:
+		// 依赖不可用时计为失败，其他拒绝原因说明对象不满足webhook的规则
+		if resp.Result != nil && resp.Result.Code == http.StatusServiceUnavailable {
+			summary.failed++
+			fmt.Fprintf(b.out, "failed %s %s: %s\n", kind, name, resp.Result.Message)
+		} else {
+			summary.skipped++
+			fmt.Fprintf(b.out, "skipped %s %s: %s\n", kind, name, resp.Result.Message)
+		}
+		return nil
+	case len(resp.Patch) == 0 || string(resp.Patch) == "null":
+		summary.unchanged++
+		return nil
+	}
+
+	patch, err := guardPatch(resp.Patch, obj.GetResourceVersion())
+	if err != nil {
+		return err
+	}
+	if b.dryRun {
+		summary.patched++
+		fmt.Fprintf(b.out, "would patch %s %s: %s\n", kind, name, resp.Patch)
+		return nil
+	}
+
+	_, err = b.whsvr.client.dynamicClient.Resource(gvr).Namespace(obj.GetNamespace()).Patch(ctx, obj.GetName(), types.JSONPatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		summary.failed++
+		fmt.Fprintf(b.out, "failed %s %s: %v\n", kind, name, err)
+		return nil
+	}
+	summary.patched++
+	fmt.Fprintf(b.out, "patched %s %s: %s\n", kind, name, resp.Patch)
+	return nil
+}
+
+// 现有对象按UPDATE请求交给mutate
+func backfillReview(kind string, gvr schema.GroupVersionResource, obj *unstructured.Unstructured, raw []byte) *v1.AdmissionReview {
+	gvk := obj.GroupVersionKind()
+	return &v1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{Kind: "AdmissionReview", APIVersion: v1.SchemeGroupVersion.String()},
+		Request: &v1.AdmissionRequest{
+			UID:       types.UID("backfill"),
+			Kind:      metav1.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: kind},
+			Resource:  metav1.GroupVersionResource{Group: gvr.Group, Version: gvr.Version, Resource: gvr.Resource},
+			Name:      obj.GetName(),
+			Namespace: obj.GetNamespace(),
+			Operation: v1.Update,
+			UserInfo:  authenticationv1.UserInfo{Username: "backfill"},
+			Object:    runtime.RawExtension{Raw: raw},
+			OldObject: runtime.RawExtension{Raw: raw},
+		},
+	}
+}
+
+// webhook的patch会整体替换labels或annotations，先校验resourceVersion，避免覆盖读取之后的修改
+func guardPatch(patch []byte, resourceVersion string) ([]byte, error) {
+	if resourceVersion == "" {
+		return patch, nil
+	}
+	var operations []patchOperation
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		return nil, err
+	}
+	guarded := append([]patchOperation{{Op: "test", Path: "/metadata/resourceVersion", Value: resourceVersion}}, operations...)
+	return json.Marshal(guarded)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+func newTestBackfiller(t *testing.T, scope sliceFlag, dryRun bool) (*backfiller, *bytes.Buffer) {
+	t.Helper()
+
+	whsvr, _ := newTestServer(t, "k8s-poc", filepath.Join("testdata", "backfill"))
+	var out bytes.Buffer
+	return &backfiller{
+		whsvr:   whsvr,
+		scope:   scope,
+		dryRun:  dryRun,
+		limiter: flowcontrol.NewFakeAlwaysRateLimiter(),
+		out:     &out,
+	}, &out
+}
+
+func TestBackfill(t *testing.T) {
+	b, out := newTestBackfiller(t, nil, false)
+	summary, err := b.run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// kube-system、team-a、team-b的标签以及team-b的网关，team-a没有子网
+	if want := (backfillSummary{patched: 4, unchanged: 1, skipped: 1}); summary != want {
+		t.Errorf("summary %+v, want %+v\n%s", summary, want, out)
+	}
+
+	client := b.whsvr.client.dynamicClient
+	for ns, vpc := range map[string]string{"kube-system": "default", "team-a": "k8s-poc-leo-test", "team-b": "k8s-poc-leo-test"} {
+		obj, err := client.Resource(namespaceGVR).Get(context.Background(), ns, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := obj.GetLabels()[admissionWebhookLabelsKey]; got != vpc {
+			t.Errorf("namespace %s labelled %q, want %q", ns, got, vpc)
+		}
+		if obj.GetLabels()[admissionWebhookWorkspaceKey] == "" {
+			t.Errorf("namespace %s lost its workspace label", ns)
+		}
+	}
+
+	router, err := client.Resource(deploymentGVR).Namespace("team-b").Get(context.Background(), "kubesphere-router-team-b", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips := router.Object["spec"].(map[string]interface{})["template"].(map[string]interface{})["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})[admissionWebhookAnnotationsKey]
+	if ips == nil || !strings.HasPrefix(ips.(string), "10.64.90.1,") {
+		t.Errorf("router annotated with %v", ips)
+	}
+
+	// 再次执行时没有需要修改的对象
+	b.out = &bytes.Buffer{}
+	if summary, err = b.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := (backfillSummary{unchanged: 5, skipped: 1}); summary != want {
+		t.Errorf("second run %+v, want %+v", summary, want)
+	}
+}
+
+func TestBackfillDryRunAndScope(t *testing.T) {
+	b, out := newTestBackfiller(t, sliceFlag{"system-workspace"}, true)
+	summary, err := b.run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (backfillSummary{patched: 1}); summary != want {
+		t.Errorf("summary %+v, want %+v\n%s", summary, want, out)
+	}
+	if !strings.Contains(out.String(), "would patch Namespace kube-system") {
+		t.Errorf("output:\n%s", out)
+	}
+
+	obj, err := b.whsvr.client.dynamicClient.Resource(namespaceGVR).Get(context.Background(), "kube-system", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := obj.GetLabels()[admissionWebhookLabelsKey]; ok {
+		t.Errorf("dry run labelled kube-system: %v", obj.GetLabels())
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// 拒绝原因的分类，每一类对应不同的HTTP状态码和StatusReason
+type admissionErrorType string
+
+const (
+	// 对象不满足准入策略
+	errPolicyViolation admissionErrorType = "PolicyViolation"
+	// 依赖的资源（业务空间、子网等）不存在
+	errMissingDependency admissionErrorType = "MissingDependency"
+	// 调用apiserver或sdn接口的临时错误，可以重试
+	errTransient admissionErrorType = "Transient"
+	// webhook自身的错误
+	errInternal admissionErrorType = "Internal"
+	// 无法处理的请求，例如不支持的资源类型或无法解析的对象
+	errBadRequest admissionErrorType = "BadRequest"
+)
+
+// 重试临时错误前建议等待的秒数
+const transientRetryAfterSeconds = 1
+
+type admissionError struct {
+	errType admissionErrorType
+	id      messageID
+	args    []interface{}
+	// 缺失依赖的资源类型和名称
+	kind string
+	name string
+	err  error
+}
+
+// 按语言生成提示信息
+func (e *admissionError) message(loc locale) string {
+	msg := localize(loc, e.id, e.args...)
+	if e.err != nil {
+		return msg + ": " + e.err.Error()
+	}
+	return msg
+}
+
+func (e *admissionError) Error() string {
+	return e.message(defaultLocale)
+}
+
+func (e *admissionError) Unwrap() error {
+	return e.err
+}
+
+func policyViolation(id messageID, args ...interface{}) *admissionError {
+	return &admissionError{errType: errPolicyViolation, id: id, args: args}
+}
+
+func missingDependency(kind, name string, id messageID, args ...interface{}) *admissionError {
+	return &admissionError{errType: errMissingDependency, id: id, args: args, kind: kind, name: name}
+}
+
+func transientError(err error, id messageID, args ...interface{}) *admissionError {
+	return &admissionError{errType: errTransient, id: id, args: args, err: err}
+}
+
+func internalError(err error, id messageID, args ...interface{}) *admissionError {
+	return &admissionError{errType: errInternal, id: id, args: args, err: err}
+}
+
+func badRequest(id messageID, args ...interface{}) *admissionError {
+	return &admissionError{errType: errBadRequest, id: id, args: args}
+}
+
+// 按错误分类生成带状态码和原因的metav1.Status
+func (e *admissionError) status(loc locale) *metav1.Status {
+	status := &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Message: e.message(loc),
+	}
+
+	switch e.errType {
+	case errPolicyViolation:
+		status.Code = http.StatusForbidden
+		status.Reason = metav1.StatusReasonForbidden
+	case errMissingDependency:
+		status.Code = http.StatusNotFound
+		status.Reason = metav1.StatusReasonNotFound
+		status.Details = &metav1.StatusDetails{Kind: e.kind, Name: e.name}
+	case errTransient:
+		status.Code = http.StatusServiceUnavailable
+		status.Reason = metav1.StatusReasonServiceUnavailable
+		status.Details = &metav1.StatusDetails{RetryAfterSeconds: transientRetryAfterSeconds}
+	case errBadRequest:
+		status.Code = http.StatusBadRequest
+		status.Reason = metav1.StatusReasonBadRequest
+	default:
+		status.Code = http.StatusInternalServerError
+		status.Reason = metav1.StatusReasonInternalError
+	}
+
+	return status
+}
+
+// 根据错误生成拒绝的AdmissionResponse，提示信息使用请求的语言，非admissionError按内部错误处理
+func denied(loc locale, err error) *v1.AdmissionResponse {
+	var admErr *admissionError
+	if !errors.As(err, &admErr) {
+		admErr = internalError(err, msgUnexpectedError)
+	}
+
+	glog.Errorf("Admission denied (%s): %v", admErr.errType, admErr)
+	return &v1.AdmissionResponse{
+		Allowed: false,
+		Result:  admErr.status(loc),
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAdmissionErrorStatus(t *testing.T) {
+	cases := []struct {
+		name    string
+		err     error
+		code    int32
+		reason  metav1.StatusReason
+		details *metav1.StatusDetails
+	}{
+		{
+			name:   "policy violation",
+			err:    policyViolation(msgNotInWorkspace, "leo"),
+			code:   http.StatusForbidden,
+			reason: metav1.StatusReasonForbidden,
+		},
+		{
+			name:    "missing dependency",
+			err:     missingDependency("workspaces", "leo-test", msgWorkspaceNotFound, "leo-test"),
+			code:    http.StatusNotFound,
+			reason:  metav1.StatusReasonNotFound,
+			details: &metav1.StatusDetails{Kind: "workspaces", Name: "leo-test"},
+		},
+		{
+			name:    "transient",
+			err:     transientError(errors.New("timeout"), msgWorkspaceLookupFailed, "leo-test"),
+			code:    http.StatusServiceUnavailable,
+			reason:  metav1.StatusReasonServiceUnavailable,
+			details: &metav1.StatusDetails{RetryAfterSeconds: transientRetryAfterSeconds},
+		},
+		{
+			name:   "bad request",
+			err:    badRequest(msgUnsupportedKind, "Secret"),
+			code:   http.StatusBadRequest,
+			reason: metav1.StatusReasonBadRequest,
+		},
+		{
+			name:   "internal",
+			err:    internalError(errors.New("boom"), msgPatchMarshalFailed),
+			code:   http.StatusInternalServerError,
+			reason: metav1.StatusReasonInternalError,
+		},
+		{
+			name:   "plain error",
+			err:    errors.New("boom"),
+			code:   http.StatusInternalServerError,
+			reason: metav1.StatusReasonInternalError,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resp := denied(localeEn, c.err)
+			if resp.Allowed {
+				t.Fatal("allowed")
+			}
+			status := resp.Result
+			if status.Status != metav1.StatusFailure || status.Code != c.code || status.Reason != c.reason {
+				t.Errorf("got %d %s, want %d %s", status.Code, status.Reason, c.code, c.reason)
+			}
+			if !reflect.DeepEqual(status.Details, c.details) {
+				t.Errorf("got details %+v, want %+v", status.Details, c.details)
+			}
+			if status.Message == "" {
+				t.Error("empty message")
+			}
+		})
+	}
+}
+
+// 被包装的原始错误追加在提示信息之后，并且可以通过errors.Is找到
+func TestAdmissionErrorWrapsCause(t *testing.T) {
+	cause := errors.New("connection refused")
+	err := transientError(cause, msgWorkspaceLookupFailed, "leo-test")
+	if !errors.Is(err, cause) {
+		t.Error("cause is not unwrapped")
+	}
+	if got, want := err.message(localeEn), localize(localeEn, msgWorkspaceLookupFailed, "leo-test")+": connection refused"; got != want {
+		t.Errorf("message %q, want %q", got, want)
+	}
+}
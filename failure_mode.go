@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// 依赖的服务(apiserver、sdn)不可用时的处理方式
+type failureMode string
+
+const (
+	failureModeDeny  failureMode = "deny"
+	failureModeAllow failureMode = "allow"
+)
+
+// 按资源类型配置的failureMode，例如: Deployment=allow,Namespace=deny，未配置的类型拒绝
+type failureModes map[string]failureMode
+
+func (m *failureModes) String() string {
+	var pairs []string
+	for kind, mode := range *m {
+		pairs = append(pairs, kind+"="+string(mode))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (m *failureModes) Set(value string) error {
+	modes := failureModes{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair == "" {
+			continue
+		}
+		kind, mode, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid failure mode %q, expect Kind=allow|deny", pair)
+		}
+		if _, ok := handlerForKind(kind); !ok {
+			return fmt.Errorf("unsupported kind %q", kind)
+		}
+		switch failureMode(mode) {
+		case failureModeAllow, failureModeDeny:
+			modes[kind] = failureMode(mode)
+		default:
+			return fmt.Errorf("invalid failure mode %q for %s, expect allow or deny", mode, kind)
+		}
+	}
+	*m = modes
+	return nil
+}
+
+func (m failureModes) forKind(kind string) failureMode {
+	if mode, ok := m[kind]; ok {
+		return mode
+	}
+	return failureModeDeny
+}
+
+// 依赖不可用而拒绝的请求，按资源类型的failureMode放行，并通过warning提示用户
+func (whsvr *WebhookServer) applyFailureMode(kind string, resp *v1.AdmissionResponse, loc locale) *v1.AdmissionResponse {
+	if resp == nil || resp.Allowed || resp.Result == nil || resp.Result.Reason != metav1.StatusReasonServiceUnavailable {
+		return resp
+	}
+	if whsvr.failureModes.forKind(kind) != failureModeAllow {
+		return resp
+	}
+
+	glog.Warningf("Dependency unavailable, allowing %s by failure mode: %s", kind, resp.Result.Message)
+	return &v1.AdmissionResponse{
+		Allowed:  true,
+		Warnings: []string{localize(loc, msgAllowedOnFailure, resp.Result.Message)},
+	}
+}
+
+// 请求的处理时限，apiserver调用webhook时会带上timeout参数，取其与-timeout中较小的值，
+// 并预留1/5的时间用于返回结果
+func (whsvr *WebhookServer) requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	timeout := whsvr.timeout
+	if t, err := time.ParseDuration(r.URL.Query().Get("timeout")); err == nil && t > 0 && (timeout <= 0 || t < timeout) {
+		timeout = t
+	}
+	if timeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), timeout-timeout/5)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestFailureModes(t *testing.T) {
+	cases := []struct {
+		name     string
+		request  string
+		modes    string
+		resource string
+		verb     string
+		allowed  bool
+		code     int
+	}{
+		{name: "deployment default deny", request: "deployment-ingress", resource: "subnets", verb: "list", code: 503},
+		{name: "deployment allow", request: "deployment-ingress", modes: "Deployment=allow", resource: "subnets", verb: "list", allowed: true},
+		{name: "namespace deny", request: "namespace-prefixed", modes: "Deployment=allow,Namespace=deny", resource: "workspaces", verb: "get", code: 503},
+		{name: "workspace allow", request: "workspace-create", modes: "Workspace=allow", resource: "vpcs", verb: "create", allowed: true},
+		// 策略类拒绝不受failureMode影响
+		{name: "policy violation", request: "namespace-no-workspace", modes: "Namespace=allow", code: 403},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			whsvr, fakeClient := newTestServer(t, "k8s-poc")
+			if err := whsvr.failureModes.Set(c.modes); err != nil {
+				t.Fatal(err)
+			}
+			if c.resource != "" {
+				fakeClient.PrependReactor(c.verb, c.resource, func(action clienttesting.Action) (bool, runtime.Object, error) {
+					return true, nil, errors.New("connection refused")
+				})
+			}
+
+			body, err := os.ReadFile(filepath.Join("testdata", "requests", c.request+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := toGolden(t, admit(t, whsvr, body), nil)
+			if got.Allowed != c.allowed || int(got.Code) != c.code {
+				t.Errorf("got allowed=%v code=%d (%s), want allowed=%v code=%d", got.Allowed, got.Code, got.Message, c.allowed, c.code)
+			}
+		})
+	}
+}
+
+func TestFailureModesFlag(t *testing.T) {
+	var modes failureModes
+	if err := modes.Set("Namespace=deny,Deployment=allow"); err != nil {
+		t.Fatal(err)
+	}
+	if modes.forKind("Deployment") != failureModeAllow || modes.forKind("Workspace") != failureModeDeny {
+		t.Errorf("unexpected modes %v", modes.String())
+	}
+	if modes.String() != "Deployment=allow,Namespace=deny" {
+		t.Errorf("unexpected string %q", modes.String())
+	}
+
+	for _, value := range []string{"Deployment", "ConfigMap=allow", "Deployment=ignore"} {
+		if err := modes.Set(value); err == nil {
+			t.Errorf("expected an error for %q", value)
+		}
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	whsvr := &WebhookServer{timeout: 10 * time.Second}
+
+	cases := []struct {
+		url  string
+		want time.Duration
+	}{
+		{url: "/mutate", want: 8 * time.Second},
+		{url: "/mutate?timeout=5s", want: 4 * time.Second},
+		{url: "/mutate?timeout=30s", want: 8 * time.Second},
+	}
+	for _, c := range cases {
+		ctx, cancel := whsvr.requestContext(httptest.NewRequest("POST", c.url, nil))
+		deadline, ok := ctx.Deadline()
+		cancel()
+		if !ok {
+			t.Fatalf("%s: no deadline", c.url)
+		}
+		if got := time.Until(deadline); got > c.want || got < c.want-time.Second {
+			t.Errorf("%s: deadline in %v, want about %v", c.url, got, c.want)
+		}
+	}
+
+	ctx, cancel := (&WebhookServer{}).requestContext(httptest.NewRequest("POST", "/mutate", nil))
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("expected no deadline without a timeout")
+	}
+	if ctx.Err() != nil {
+		t.Error("expected a live context")
+	}
+}
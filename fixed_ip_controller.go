@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// 网关删除后释放或记录它的固定IP，只在leader上运行
+//
+// 网关独占固定IP的sdn(Calico)由webhook预留地址，这里删除网关的预留并记录为release
+// 其他sdn的固定IP通过注解(例如nci.yunshan.net/ips)申请，是namespace子网中的地址，pod删除后由sdn回收，
+// 子网由子网控制器释放，这里只把没有其他网关再使用的地址记录为unpin
+type fixedIPController struct {
+	client Client
+	audit  *auditLogger
+	resync time.Duration
+}
+
+func (c *fixedIPController) run(ctx context.Context) {
+	gvrs, err := servedResources(c.client.kubeClient.Discovery(), gatewayWorkloadGVRs)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("discover gateway workloads: %v", err))
+	}
+
+	// 只监听带网关标签的对象
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(c.client.dynamicClient, c.resync, metav1.NamespaceAll, func(options *metav1.ListOptions) {
+		options.LabelSelector = gatewaySelector
+	})
+	var (
+		indexers []cache.Indexer
+		synced   []cache.InformerSynced
+		watched  = make(map[string]cache.Indexer)
+	)
+	for _, gvr := range gvrs {
+		informer := factory.ForResource(gvr).Informer()
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			DeleteFunc: func(obj interface{}) { c.deleted(ctx, indexers, obj) },
+		})
+		indexers = append(indexers, informer.GetIndexer())
+		synced = append(synced, informer.HasSynced)
+		if h, ok := handlerForGVR(gvr); ok {
+			watched[h.kind] = informer.GetIndexer()
+		}
+	}
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		return
+	}
+	if reserver, ok := c.client.backend().(fixedIPReserver); ok {
+		c.releaseOrphans(ctx, reserver, watched)
+	}
+	<-ctx.Done()
+}
+
+// 没有leader时删除的网关收不到事件，新的leader启动时释放网关已经不存在的预留
+func (c *fixedIPController) releaseOrphans(ctx context.Context, reserver fixedIPReserver, watched map[string]cache.Indexer) {
+	gateways, err := reserver.reservedGateways(ctx, c.client.dynamicClient)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("list fixed ip reservations: %v", err))
+		return
+	}
+	for _, gateway := range gateways {
+		// 没有监听的资源无法判断网关是否存在
+		indexer, ok := watched[gateway.Kind]
+		if !ok {
+			continue
+		}
+		if _, exists, err := indexer.GetByKey(gateway.Namespace + "/" + gateway.Name); err != nil || exists {
+			continue
+		}
+		c.release(ctx, reserver, gateway, "gateway not found")
+	}
+}
+
+func (c *fixedIPController) release(ctx context.Context, reserver fixedIPReserver, gateway gatewayRef, reason string) {
+	ips, err := reserver.releaseFixedIPs(ctx, c.client.dynamicClient, gateway)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("release fixed ips of %s: %v", gateway, err))
+	}
+	if len(ips) == 0 {
+		return
+	}
+	glog.Infof("Released fixed ips %s of %s", strings.Join(ips, ","), gateway)
+	c.audit.record(auditEntry{
+		Action:    "release",
+		Resource:  "fixedIPs",
+		Namespace: gateway.Namespace,
+		Name:      gateway.Name,
+		IPs:       strings.Join(ips, ","),
+		Reason:    reason,
+	})
+}
+
+// 集群中提供的资源，没有安装的CRD(例如Argo Rollouts、OpenKruise)不监听
+func servedResources(client discovery.DiscoveryInterface, gvrs []schema.GroupVersionResource) ([]schema.GroupVersionResource, error) {
+	var (
+		served []schema.GroupVersionResource
+		errs   []error
+	)
+	for _, gvr := range gvrs {
+		resources, err := client.ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, resource := range resources.APIResources {
+			if resource.Name == gvr.Resource {
+				served = append(served, gvr)
+				break
+			}
+		}
+	}
+	return served, utilerrors.NewAggregate(errs)
+}
+
+// indexers为所有网关资源的缓存，删除事件到达时被删除的对象已经不在缓存中
+func (c *fixedIPController) deleted(ctx context.Context, indexers []cache.Indexer, obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	gateway, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	if reserver, ok := c.client.backend().(fixedIPReserver); ok {
+		ref := gatewayRef{Kind: gateway.GetKind(), Namespace: gateway.GetNamespace(), Name: gateway.GetName()}
+		c.release(ctx, reserver, ref, strings.ToLower(gateway.GetKind())+" deleted")
+		return
+	}
+	key := c.client.backend().fixedIPsKey()
+	ips := gatewayPinnedIPs(gateway, key)
+	if len(ips) == 0 {
+		return
+	}
+
+	// 同一namespace的网关使用同一组固定IP，其他网关仍在使用的地址不记录
+	pinned := make(map[string]bool)
+	for _, indexer := range indexers {
+		items, err := indexer.ByIndex(cache.NamespaceIndex, gateway.GetNamespace())
+		if err != nil {
+			utilruntime.HandleError(err)
+			return
+		}
+		for _, item := range items {
+			if other, ok := item.(*unstructured.Unstructured); ok {
+				for _, ip := range gatewayPinnedIPs(other, key) {
+					pinned[ip] = true
+				}
+			}
+		}
+	}
+	var unpinned []string
+	for _, ip := range ips {
+		if !pinned[ip] {
+			unpinned = append(unpinned, ip)
+		}
+	}
+	if len(unpinned) == 0 {
+		glog.Infof("%s %s/%s deleted, its fixed ips are still pinned by other gateways", gateway.GetKind(), gateway.GetNamespace(), gateway.GetName())
+		return
+	}
+
+	glog.Infof("%s %s/%s deleted, fixed ips %s are no longer pinned by any gateway", gateway.GetKind(), gateway.GetNamespace(), gateway.GetName(), strings.Join(unpinned, ","))
+	c.audit.record(auditEntry{
+		Action:    "unpin",
+		Resource:  "fixedIPs",
+		Namespace: gateway.GetNamespace(),
+		Name:      gateway.GetName(),
+		IPs:       strings.Join(unpinned, ","),
+		Reason:    strings.ToLower(gateway.GetKind()) + " deleted",
+	})
+}
+
+// 网关pod模板或pod上的固定IP
+func gatewayPinnedIPs(gateway *unstructured.Unstructured, key string) []string {
+	annotations, _, _ := unstructured.NestedStringMap(gateway.Object, append(gatewayPodMetadata(gateway.GroupVersionKind().GroupKind()), "annotations")...)
+	return parseFixedIPs(annotations[key])
+}
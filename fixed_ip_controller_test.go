@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+// team-a的Deployment和DaemonSet共用同一组固定IP，team-b是单独创建的pod
+const pinnedGateways = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: ingress
+  namespace: team-a
+  labels:
+    app.kubernetes.io/component: controller
+    app.kubernetes.io/name: ingress-nginx
+spec:
+  template:
+    metadata:
+      annotations:
+        nci.yunshan.net/ips: 10.64.1.1,10.64.1.2
+---
+apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: edge
+  namespace: team-a
+  labels:
+    app.kubernetes.io/component: controller
+    app.kubernetes.io/name: ingress-nginx
+spec:
+  template:
+    metadata:
+      annotations:
+        nci.yunshan.net/ips: 10.64.1.2
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  namespace: team-a
+  labels:
+    app.kubernetes.io/component: controller
+    app.kubernetes.io/name: ingress-nginx
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: ingress
+  namespace: team-b
+  labels:
+    app.kubernetes.io/component: controller
+    app.kubernetes.io/name: ingress-nginx
+  annotations:
+    nci.yunshan.net/ips: 10.64.2.1
+`
+
+func TestFixedIPControllerAuditsUnpinnedIPs(t *testing.T) {
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := newAuditLogger(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &fixedIPController{audit: audit}
+
+	objects, err := decodeManifests([]byte(pinnedGateways))
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, obj := range objects {
+		if err := indexer.Add(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 与informer一样，删除事件到达前对象已经从缓存中移除
+	remove := func(i int) *unstructured.Unstructured {
+		if err := indexer.Delete(objects[i]); err != nil {
+			t.Fatal(err)
+		}
+		return objects[i]
+	}
+	indexers := []cache.Indexer{indexer}
+
+	// DaemonSet仍在使用10.64.1.2
+	c.deleted(context.Background(), indexers, remove(0))
+	c.deleted(context.Background(), indexers, remove(2))
+	c.deleted(context.Background(), indexers, remove(1))
+	c.deleted(context.Background(), indexers, cache.DeletedFinalStateUnknown{Key: "team-b/ingress", Obj: remove(3)})
+
+	entries := readAudit(t, auditPath)
+	want := []auditEntry{
+		{Namespace: "team-a", Name: "ingress", IPs: "10.64.1.1", Reason: "deployment deleted"},
+		{Namespace: "team-a", Name: "edge", IPs: "10.64.1.2", Reason: "daemonset deleted"},
+		{Namespace: "team-b", Name: "ingress", IPs: "10.64.2.1", Reason: "pod deleted"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d audit entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i, w := range want {
+		if e := entries[i]; e.Action != "unpin" || e.Resource != "fixedIPs" || e.Namespace != w.Namespace || e.Name != w.Name || e.IPs != w.IPs || e.Reason != w.Reason {
+			t.Errorf("unexpected audit entry %+v, want %+v", e, w)
+		}
+	}
+}
+
+// Calico的网关删除后释放它预留的地址，新的leader启动时释放网关已经不存在的预留
+func TestFixedIPControllerReleasesReservations(t *testing.T) {
+	objects, err := decodeManifests([]byte(pinnedGateways))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reservations := map[gatewayRef]string{
+		{Kind: "Deployment", Namespace: "team-a", Name: "ingress"}: "10.32.0.1",
+		{Kind: "Pod", Namespace: "team-b", Name: "ingress"}:        "10.32.0.2",
+		{Kind: "Pod", Namespace: "team-c", Name: "gone"}:           "10.32.0.3",
+		{Kind: "Rollout", Namespace: "team-c", Name: "canary"}:     "10.32.0.4",
+	}
+	for gateway, ip := range reservations {
+		objects = append(objects, newCalicoReservation(netip.MustParseAddr(ip), gateway))
+	}
+	dynamicClient, err := newFakeClient(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := newAuditLogger(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &fixedIPController{client: Client{dynamicClient: dynamicClient, sdn: calicoBackend{}}, audit: audit}
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, obj := range objects[:4] {
+		if err := indexer.Add(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+	if err := indexer.Delete(objects[0]); err != nil {
+		t.Fatal(err)
+	}
+	c.deleted(ctx, []cache.Indexer{indexer}, objects[0])
+	// 没有监听Rollout，不能判断canary是否存在
+	c.releaseOrphans(ctx, calicoBackend{}, map[string]cache.Indexer{"Deployment": indexer, "Pod": indexer})
+
+	list, err := dynamicClient.Resource(calicoIPReservationGVR).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, item := range list.Items {
+		kept = append(kept, item.GetName())
+	}
+	sort.Strings(kept)
+	if want := []string{"ks-gateway-10-32-0-2", "ks-gateway-10-32-0-4"}; !reflect.DeepEqual(kept, want) {
+		t.Errorf("kept reservations %v, want %v", kept, want)
+	}
+
+	entries := readAudit(t, auditPath)
+	want := []auditEntry{
+		{Namespace: "team-a", Name: "ingress", IPs: "10.32.0.1", Reason: "deployment deleted"},
+		{Namespace: "team-c", Name: "gone", IPs: "10.32.0.3", Reason: "gateway not found"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d audit entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i, w := range want {
+		if e := entries[i]; e.Action != "release" || e.Resource != "fixedIPs" || e.Namespace != w.Namespace || e.Name != w.Name || e.IPs != w.IPs || e.Reason != w.Reason {
+			t.Errorf("unexpected audit entry %+v, want %+v", e, w)
+		}
+	}
+}
+
+// 只监听集群中提供的资源，没有安装Argo Rollouts和OpenKruise时同样可以运行
+func TestFixedIPControllerWatchesServedGateways(t *testing.T) {
+	objects, err := decodeManifests([]byte(pinnedGateways))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dynamicClient, err := newFakeClient(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kubeClient := kubefake.NewSimpleClientset()
+	kubeClient.Resources = []*metav1.APIResourceList{
+		{GroupVersion: "v1", APIResources: []metav1.APIResource{{Name: "pods"}}},
+		{GroupVersion: "apps/v1", APIResources: []metav1.APIResource{{Name: "deployments"}, {Name: "replicasets"}, {Name: "daemonsets"}}},
+	}
+
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := newAuditLogger(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &fixedIPController{client: Client{dynamicClient: dynamicClient, kubeClient: kubeClient}, audit: audit}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.run(ctx)
+
+	// informer开始watch后删除team-b的pod
+	watching := func(context.Context) (bool, error) {
+		for _, action := range dynamicClient.Actions() {
+			if action.GetVerb() == "watch" && action.GetResource() == podGVR {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	if err := wait.PollUntilContextTimeout(ctx, 20*time.Millisecond, 5*time.Second, true, watching); err != nil {
+		t.Fatalf("pods are not watched: %v", err)
+	}
+	if err := dynamicClient.Resource(podGVR).Namespace("team-b").Delete(ctx, "ingress", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	err = wait.PollUntilContextTimeout(ctx, 20*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+		data, _ := os.ReadFile(auditPath)
+		return len(data) > 0, nil
+	})
+	if err != nil {
+		t.Fatalf("no audit entry for the deleted pod: %v", err)
+	}
+	for _, action := range dynamicClient.Actions() {
+		if action.GetResource() == rolloutGVR {
+			t.Errorf("unexpected %s of rollouts, which are not served", action.GetVerb())
+		}
+	}
+	if entries := readAudit(t, auditPath); entries[0].Namespace != "team-b" || entries[0].IPs != "10.64.2.1" {
+		t.Errorf("unexpected audit entry %+v", entries[0])
+	}
+}
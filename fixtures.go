@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+// 离线模拟时支持的资源，不同sdn的Subnet同名，按group区分
+var fixtureResources = map[schema.GroupKind]schema.GroupVersionResource{
+	{Group: workspaceGVR.Group, Kind: "Workspace"}:               workspaceGVR,
+	{Group: vpcGVR.Group, Kind: "VPC"}:                           vpcGVR,
+	{Group: subnetGVR.Group, Kind: "Subnet"}:                     subnetGVR,
+	{Group: kubeOVNVpcGVR.Group, Kind: "Vpc"}:                    kubeOVNVpcGVR,
+	{Group: kubeOVNSubnetGVR.Group, Kind: "Subnet"}:              kubeOVNSubnetGVR,
+	{Group: calicoIPPoolGVR.Group, Kind: "IPPool"}:               calicoIPPoolGVR,
+	{Group: calicoIPReservationGVR.Group, Kind: "IPReservation"}: calicoIPReservationGVR,
+	{Group: namespaceGVR.Group, Kind: "Namespace"}:               namespaceGVR,
+	{Group: deploymentGVR.Group, Kind: "Deployment"}:             deploymentGVR,
+	{Group: replicaSetGVR.Group, Kind: "ReplicaSet"}:             replicaSetGVR,
+	{Group: daemonSetGVR.Group, Kind: "DaemonSet"}:               daemonSetGVR,
+	{Group: podGVR.Group, Kind: "Pod"}:                           podGVR,
+	{Group: rolloutGVR.Group, Kind: "Rollout"}:                   rolloutGVR,
+	{Group: cloneSetGVR.Group, Kind: "CloneSet"}:                 cloneSetGVR,
+	{Group: advancedStatefulSetGVR.Group, Kind: "StatefulSet"}:   advancedStatefulSetGVR,
+	{Group: webhookPolicyGVR.Group, Kind: "WebhookPolicy"}:       webhookPolicyGVR,
+}
+
+// 从文件或目录中读取资源清单，目录下只读取.yaml/.yml/.json文件
+func loadFixtures(paths []string) ([]*unstructured.Unstructured, error) {
+	var objects []*unstructured.Unstructured
+
+	for _, path := range paths {
+		files, err := fixtureFiles(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+
+			objs, err := decodeManifests(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+			objects = append(objects, objs...)
+		}
+	}
+
+	return objects, nil
+}
+
+func fixtureFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".yaml", ".yml", ".json":
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+	return files, nil
+}
+
+// 解析多文档的YAML或JSON清单，List类型会展开为其中的对象
+func decodeManifests(data []byte) ([]*unstructured.Unstructured, error) {
+	var objects []*unstructured.Unstructured
+
+	decoder := utilyaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096)
+	for {
+		obj := &unstructured.Unstructured{}
+		if err := decoder.Decode(&obj.Object); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if len(obj.Object) == 0 {
+			continue
+		}
+
+		if obj.IsList() {
+			err := obj.EachListItem(func(item runtime.Object) error {
+				objects = append(objects, item.(*unstructured.Unstructured))
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		objects = append(objects, obj)
+	}
+
+	return objects, nil
+}
+
+// 使用清单中的资源构造假的DynamicClient
+func newFakeClient(objects []*unstructured.Unstructured) (*dynamicfake.FakeDynamicClient, error) {
+	listKinds := make(map[schema.GroupVersionResource]string)
+	for gk, gvr := range fixtureResources {
+		listKinds[gvr] = gk.Kind + "List"
+	}
+
+	var objs []runtime.Object
+	for _, obj := range objects {
+		if _, ok := fixtureResources[obj.GroupVersionKind().GroupKind()]; !ok {
+			return nil, fmt.Errorf("unsupported fixture kind %q (%s)", obj.GetKind(), obj.GetName())
+		}
+		objs = append(objs, obj)
+	}
+
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objs...), nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// 查找网关时检查的工作负载，即注入固定ip的处理器的资源
+var gatewayWorkloadGVRs []schema.GroupVersionResource
+
+// Service的处理器的权限引用了gatewayWorkloadGVRs，在init中生成以免初始化循环
+func init() {
+	for _, h := range admissionHandlers {
+		if h.gateway && h.gvr != serviceGVR {
+			gatewayWorkloadGVRs = append(gatewayWorkloadGVRs, h.gvr)
+		}
+	}
+}
+
+// 平台网关应用的标签，与checkKsIngress一致，webhook配置的objectSelector也使用这些标签
+var gatewayLabels = map[string]string{
+	"app.kubernetes.io/component": "controller",
+	"app.kubernetes.io/name":      "ingress-nginx",
+}
+
+var gatewaySelector = labels.SelectorFromSet(gatewayLabels).String()
+
+// 选中固定ip网关pod的Service，从同一组固定ip中填写externalIPs或loadBalancerIP
+func mutateService(svmate serverMate, svc *corev1.Service) *v1.AdmissionResponse {
+	resourceName, resourceNamespace := svc.Name, svc.Namespace
+
+	if !admissionRequired(admissionWebhookAnnotationMutateKey, &svc.ObjectMeta) {
+		glog.Infof("Skipping validation for %s due to policy check", resourceName)
+		return &v1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	//通过标签判断是否为网关Service
+	if !checkKsIngress(&svc.ObjectMeta, resourceName) {
+		return patchResponse(svmate.locale, nil)
+	}
+
+	// 没有selector或headless的Service不会转发到网关pod
+	if len(svc.Spec.Selector) == 0 || svc.Spec.Type == corev1.ServiceTypeExternalName || svc.Spec.ClusterIP == corev1.ClusterIPNone {
+		return patchResponse(svmate.locale, nil)
+	}
+
+	//按WebhookPolicy判断是否同步固定ip
+	client := svmate.client
+	nsLabels, err := client.namespaceLabels(svmate.ctx, resourceNamespace)
+	if err != nil {
+		return denied(svmate.locale, transientError(err, msgNamespaceLookupFailed, resourceNamespace))
+	}
+	enabled, err := client.featureEnabled(svmate.ctx, featureFixedIPs, policySubject{
+		workspace:       nsLabels[admissionWebhookWorkspaceKey],
+		namespaceLabels: nsLabels,
+		objectLabels:    svc.Labels,
+	})
+	if err != nil {
+		return denied(svmate.locale, transientError(err, msgPolicyLookupFailed))
+	}
+	if !enabled {
+		glog.Infof("%s的固定ip功能被WebhookPolicy关闭，跳过同步", resourceName)
+		return patchResponse(svmate.locale, nil)
+	}
+
+	ips, err := client.gatewayFixedIPs(svmate.ctx, resourceNamespace, svc.Spec.Selector)
+	if err != nil {
+		return denied(svmate.locale, transientError(err, msgGatewayLookupFailed, resourceNamespace))
+	}
+	if len(ips) == 0 {
+		glog.Infof("Service %s没有选中固定ip的网关，跳过", resourceName)
+		return patchResponse(svmate.locale, nil)
+	}
+
+	return patchResponse(svmate.locale, serviceIPPatches(svc, ips))
+}
+
+// namespace中被selector选中的网关pod模板上的固定ip，没有时返回nil
+func (c *Client) gatewayFixedIPs(ctx context.Context, namespace string, selector map[string]string) ([]string, error) {
+	key := c.backend().fixedIPsKey()
+	matches := labels.SelectorFromSet(selector)
+
+	for _, gvr := range gatewayWorkloadGVRs {
+		list, err := c.dynamicClient.Resource(gvr).Namespace(namespace).List(ctx, metav1.ListOptions{LabelSelector: gatewaySelector})
+		// 集群中没有安装Argo Rollouts或OpenKruise
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			metadata := gatewayPodMetadata(item.GroupVersionKind().GroupKind())
+			podLabels, _, _ := unstructured.NestedStringMap(item.Object, append(metadata, "labels")...)
+			if !matches.Matches(labels.Set(podLabels)) {
+				continue
+			}
+			annotations, _, _ := unstructured.NestedStringMap(item.Object, append(metadata, "annotations")...)
+			if value := annotations[key]; value != "" {
+				return parseFixedIPs(value), nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// 网关pod的metadata在对象中的位置，单独创建的pod没有模板
+func gatewayPodMetadata(gk schema.GroupKind) []string {
+	if gk == (schema.GroupKind{Kind: "Pod"}) {
+		return []string{"metadata"}
+	}
+	return []string{"spec", "template", "metadata"}
+}
+
+// 固定ip的annotation为逗号分隔的地址或JSON数组(Calico)
+func parseFixedIPs(value string) []string {
+	var ips []string
+	if strings.HasPrefix(value, "[") {
+		if err := json.Unmarshal([]byte(value), &ips); err != nil {
+			glog.Warningf("Invalid fixed ips %s: %v", value, err)
+		}
+		return ips
+	}
+	for _, ip := range strings.Split(value, ",") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// LoadBalancer使用第一个地址作为loadBalancerIP，其他类型把所有地址填入externalIPs
+// 已经填写的地址都在固定ip中时不修改
+func serviceIPPatches(svc *corev1.Service, ips []string) []patchOperation {
+	pool := sliceFlag(ips)
+
+	if svc.Spec.Type == corev1.ServiceTypeLoadBalancer {
+		if pool.has(svc.Spec.LoadBalancerIP) {
+			return nil
+		}
+		return []patchOperation{{Op: "add", Path: "/spec/loadBalancerIP", Value: ips[0]}}
+	}
+
+	inPool := len(svc.Spec.ExternalIPs) > 0
+	for _, ip := range svc.Spec.ExternalIPs {
+		if !pool.has(ip) {
+			inPool = false
+			break
+		}
+	}
+	if inPool {
+		return nil
+	}
+	return []patchOperation{{Op: "add", Path: "/spec/externalIPs", Value: ips}}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMutateService(t *testing.T) {
+	whsvr, _ := newTestServer(t, "k8s-poc", filepath.Join("testdata", "services"))
+
+	cases := []struct {
+		name   string
+		labels string
+		spec   string
+		patch  []patchOperation
+	}{
+		{
+			name: "cluster ip",
+			spec: `
+  selector:
+    app: kubesphere-router-kube-system`,
+			patch: []patchOperation{{Op: "add", Path: "/spec/externalIPs", Value: []interface{}{"10.64.88.1", "10.64.88.2", "10.64.88.3"}}},
+		},
+		{
+			name: "load balancer",
+			spec: `
+  type: LoadBalancer
+  loadBalancerIP: 192.168.1.10
+  selector:
+    app: kubesphere-router-kube-system`,
+			patch: []patchOperation{{Op: "add", Path: "/spec/loadBalancerIP", Value: "10.64.88.1"}},
+		},
+		{
+			name: "external ips in pool",
+			spec: `
+  externalIPs:
+  - 10.64.88.2
+  selector:
+    app: kubesphere-router-kube-system`,
+		},
+		{
+			name: "rollout",
+			spec: `
+  selector:
+    app: kubesphere-router-canary`,
+			patch: []patchOperation{{Op: "add", Path: "/spec/externalIPs", Value: []interface{}{"10.64.88.4", "10.64.88.5"}}},
+		},
+		{
+			name: "bare pod",
+			spec: `
+  selector:
+    app: kubesphere-router-standalone`,
+			patch: []patchOperation{{Op: "add", Path: "/spec/externalIPs", Value: []interface{}{"10.64.88.6"}}},
+		},
+		{
+			name: "other pods",
+			spec: `
+  selector:
+    app: redis`,
+		},
+		{
+			name: "not a gateway",
+			labels: `
+    app: kubesphere-router-kube-system`,
+			spec: `
+  selector:
+    app: kubesphere-router-kube-system`,
+		},
+		{
+			name: "headless",
+			spec: `
+  clusterIP: None
+  selector:
+    app: kubesphere-router-kube-system`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			labels := c.labels
+			if labels == "" {
+				labels = `
+    app.kubernetes.io/component: controller
+    app.kubernetes.io/name: ingress-nginx`
+			}
+			ar, err := simulatedReview([]byte(`
+apiVersion: v1
+kind: Service
+metadata:
+  name: kubesphere-router-kube-system
+  namespace: kube-system
+  labels:`+labels+`
+spec:`+c.spec), "CREATE")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp := whsvr.mutate(context.Background(), ar, localeEn)
+			if !resp.Allowed {
+				t.Fatalf("denied: %v", resp.Result.Message)
+			}
+			var patch []patchOperation
+			if err := json.Unmarshal(resp.Patch, &patch); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(patch, c.patch) {
+				t.Errorf("patch %s", resp.Patch)
+			}
+		})
+	}
+}
+
+// 固定ip被WebhookPolicy关闭时不查询网关工作负载
+func TestMutateServicePolicyOff(t *testing.T) {
+	whsvr, fakeClient := newTestServer(t, "k8s-poc", filepath.Join("testdata", "services"), filepath.Join("testdata", "policies"))
+	ar, err := simulatedReview([]byte(`
+apiVersion: v1
+kind: Service
+metadata:
+  name: kubesphere-router-kube-system
+  namespace: kube-system
+  labels:
+    app.kubernetes.io/component: controller
+    app.kubernetes.io/name: ingress-nginx
+spec:
+  selector:
+    app: kubesphere-router-kube-system`), "CREATE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := len(fakeClient.Actions())
+	resp := whsvr.mutate(context.Background(), ar, localeEn)
+	if !resp.Allowed || string(resp.Patch) != "null" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	for _, action := range fakeClient.Actions()[actions:] {
+		for _, gvr := range gatewayWorkloadGVRs {
+			if action.GetResource() == gvr {
+				t.Errorf("unexpected %s of %s", action.GetVerb(), gvr.Resource)
+			}
+		}
+	}
+}
+
+func TestParseFixedIPs(t *testing.T) {
+	for value, want := range map[string][]string{
+		"10.64.88.1, 10.64.88.2": {"10.64.88.1", "10.64.88.2"},
+		`["10.32.0.1"]`:          {"10.32.0.1"},
+		"":                       nil,
+	} {
+		if got := parseFixedIPs(value); !reflect.DeepEqual(got, want) {
+			t.Errorf("parseFixedIPs(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
@@ -2,69 +2,37 @@ package main
 
 import (
 	"context"
-	"strconv"
-	"strings"
 
 	"github.com/golang/glog"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
-func (c *Client) getSubnet(namespace string) string {
-
-	var cidr string
-
-	// 设置要请求的 GVR
-	gvr := schema.GroupVersionResource{
-		Group:    "nci.yunshan.net",
-		Version:  "v1",
-		Resource: "subnets",
-	}
-
-	// 发送请求，并得到返回结果
-	unStructData, err := c.dynamicClient.Resource(gvr).Namespace(namespace).List(context.TODO(), metav1.ListOptions{})
-	if err != nil {
-		panic(err.Error())
-	}
-
-	var obj Nets
-
-	// 使用 runtime.DefaultUnstructuredConverter 转换 item 为对象
-	err = runtime.DefaultUnstructuredConverter.FromUnstructured(unStructData.UnstructuredContent(), &obj)
+// namespace关联的子网，有多个时使用最后一个
+func (c *Client) getSubnet(ctx context.Context, namespace string) (sdnSubnet, error) {
+	subnets, err := c.namespaceSubnets(ctx, namespace)
 	if err != nil {
-		glog.Infof("Failed to convert item: %v\n", err)
-		return "ERROR"
+		glog.Infof("Failed to look up subnets of %s: %v", namespace, err)
+		return sdnSubnet{}, err
 	}
 
-	// 输出资源信息
-	for _, item := range obj.Items {
-		cidr = item.Spec.CIDR
+	var subnet sdnSubnet
+	if len(subnets) > 0 {
+		subnet = subnets[len(subnets)-1]
 	}
 
-	if cidr == "" {
+	if subnet.CIDR == "" {
 		glog.Infof("没有找到子网资源，请检查网络插件")
-		return "ERROR"
+		return sdnSubnet{}, missingDependency("subnets", namespace, msgSubnetNotFound, namespace)
 	}
 
-	return cidr
-
+	return subnet, nil
 }
 
-// 生成描述键值对
-func createAnnotation(net string) map[string]string {
-	ip := []string{}
-	ips := make(map[string]string)
-	net = strings.Split(net, "/")[0]
-	tmp := strings.Split(net, ".")
-	i, _ := strconv.Atoi(tmp[3])
-	for j := 0; j < 15; j++ {
-		i += 1
-		tmp[3] = strconv.Itoa(i)
-		ip = append(ip, strings.Join(tmp, "."))
+// 生成固定ip的描述键值对
+func (c *Client) createAnnotation(ctx context.Context, subnet sdnSubnet, gateway gatewayRef, dryRun bool) (map[string]string, error) {
+	backend := c.backend()
+	ips, err := backend.fixedIPs(ctx, c.dynamicClient, subnet, gateway, dryRun)
+	if err != nil {
+		return nil, err
 	}
-
-	ips["nci.yunshan.net/ips"] = strings.Join(ip, ",")
-
-	return ips
+	return map[string]string{backend.fixedIPsKey(): ips}, nil
 }
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// 生成对象的patch
+type mutator interface {
+	mutate(svmate serverMate, req *v1.AdmissionRequest) *v1.AdmissionResponse
+}
+
+// 在mutator之前检查对象，返回错误时拒绝请求
+type validator interface {
+	validate(svmate serverMate, req *v1.AdmissionRequest) error
+}
+
+type mutatorFunc func(svmate serverMate, req *v1.AdmissionRequest) *v1.AdmissionResponse
+
+func (f mutatorFunc) mutate(svmate serverMate, req *v1.AdmissionRequest) *v1.AdmissionResponse {
+	return f(svmate, req)
+}
+
+type validatorFunc func(svmate serverMate, req *v1.AdmissionRequest) error
+
+func (f validatorFunc) validate(svmate serverMate, req *v1.AdmissionRequest) error {
+	return f(svmate, req)
+}
+
+// webhook处理的资源及其依赖的权限，manifests子命令据此生成MutatingWebhookConfiguration和RBAC
+// 请求按GroupVersionKind和操作交给对应的处理器，每个处理器也可以通过自己的路径访问
+type handlerSpec struct {
+	kind       string
+	gvr        schema.GroupVersionResource
+	operations []admissionregistrationv1.OperationType
+	feature    feature
+	// 处理请求时会修改其他资源，例如创建vpc、把namespace登记到vpc或者为网关预留固定ip，dryRun的请求需要跳过
+	sideEffects bool
+	// 只处理带网关标签的对象，webhook通过objectSelector过滤其他对象
+	gateway bool
+	// vpc和子网的权限取决于使用的sdn
+	rules     func(sdn sdnBackend) []rbacv1.PolicyRule
+	validator validator
+	mutator   mutator
+}
+
+func (h handlerSpec) gvk() schema.GroupVersionKind {
+	return h.gvr.GroupVersion().WithKind(h.kind)
+}
+
+// 处理器单独的路径，例如/mutate/namespaces
+func (h handlerSpec) path() string {
+	return "/mutate/" + h.gvr.Resource
+}
+
+func (h handlerSpec) handles(op v1.Operation) bool {
+	for _, o := range h.operations {
+		if string(o) == string(op) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	namespaceGVR  = schema.GroupVersionResource{Group: "", Version: "v1", Resource: "namespaces"}
+	deploymentGVR = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	replicaSetGVR = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"}
+	daemonSetGVR  = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "daemonsets"}
+	podGVR        = schema.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
+	serviceGVR    = schema.GroupVersionResource{Group: "", Version: "v1", Resource: "services"}
+	workspaceGVR  = schema.GroupVersionResource{Group: "tenant.kubesphere.io", Version: "v1alpha1", Resource: "workspaces"}
+)
+
+var admissionHandlers = []handlerSpec{
+	{
+		kind:        "Namespace",
+		gvr:         namespaceGVR,
+		operations:  []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+		feature:     featureVpcLabel,
+		sideEffects: true,
+		rules: func(sdn sdnBackend) []rbacv1.PolicyRule {
+			rules := []rbacv1.PolicyRule{
+				{APIGroups: []string{workspaceGVR.Group}, Resources: []string{workspaceGVR.Resource}, Verbs: []string{"get", "list", "watch"}},
+			}
+			if _, ok := sdn.(vpcMembership); ok {
+				rules = append(rules, rbacv1.PolicyRule{APIGroups: []string{sdn.vpcResource().Group}, Resources: []string{sdn.vpcResource().Resource}, Verbs: []string{"get", "list", "watch", "update"}})
+			}
+			return rules
+		},
+		validator: namespaceValidator,
+		mutator:   namespaceMutator,
+	},
+	{
+		kind:        "Deployment",
+		gvr:         deploymentGVR,
+		operations:  []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+		feature:     featureFixedIPs,
+		gateway:     true,
+		sideEffects: true,
+		rules:       fixedIPRules(deploymentGVR),
+		mutator:     deploymentMutator,
+	},
+	{
+		kind:        "ReplicaSet",
+		gvr:         replicaSetGVR,
+		operations:  []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+		feature:     featureFixedIPs,
+		gateway:     true,
+		sideEffects: true,
+		rules:       fixedIPRules(replicaSetGVR),
+		mutator:     replicaSetMutator,
+	},
+	{
+		kind:       "DaemonSet",
+		gvr:        daemonSetGVR,
+		operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+		feature:    featureFixedIPs,
+		gateway:    true,
+		rules:      fixedIPRules(daemonSetGVR),
+		mutator:    daemonSetMutator,
+	},
+	{
+		// pod的ip在创建时分配，更新时注入没有意义
+		kind:        "Pod",
+		gvr:         podGVR,
+		operations:  []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+		feature:     featureFixedIPs,
+		gateway:     true,
+		sideEffects: true,
+		rules:       fixedIPRules(podGVR),
+		mutator:     podMutator,
+	},
+	{
+		kind:        "Rollout",
+		gvr:         rolloutGVR,
+		operations:  []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+		feature:     featureFixedIPs,
+		gateway:     true,
+		sideEffects: true,
+		rules:       fixedIPRules(rolloutGVR),
+		mutator:     templateWorkloadMutator,
+	},
+	{
+		kind:        "CloneSet",
+		gvr:         cloneSetGVR,
+		operations:  []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+		feature:     featureFixedIPs,
+		gateway:     true,
+		sideEffects: true,
+		rules:       fixedIPRules(cloneSetGVR),
+		mutator:     templateWorkloadMutator,
+	},
+	{
+		// OpenKruise Advanced StatefulSet，apps/v1的StatefulSet不在webhook的规则中
+		kind:        "StatefulSet",
+		gvr:         advancedStatefulSetGVR,
+		operations:  []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+		feature:     featureFixedIPs,
+		gateway:     true,
+		sideEffects: true,
+		rules:       fixedIPRules(advancedStatefulSetGVR),
+		mutator:     templateWorkloadMutator,
+	},
+	{
+		// 从选中的网关工作负载上读取固定ip
+		kind:       "Service",
+		gvr:        serviceGVR,
+		operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+		feature:    featureFixedIPs,
+		gateway:    true,
+		rules: func(sdnBackend) []rbacv1.PolicyRule {
+			var rules []rbacv1.PolicyRule
+			for _, gvr := range gatewayWorkloadGVRs {
+				rules = append(rules, rbacv1.PolicyRule{APIGroups: []string{gvr.Group}, Resources: []string{gvr.Resource}, Verbs: []string{"get", "list", "watch"}})
+			}
+			return rules
+		},
+		mutator: serviceMutator,
+	},
+	{
+		kind:        "Workspace",
+		gvr:         workspaceGVR,
+		operations:  []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Delete},
+		feature:     featureVpcLifecycle,
+		sideEffects: true,
+		rules: func(sdn sdnBackend) []rbacv1.PolicyRule {
+			return []rbacv1.PolicyRule{
+				{APIGroups: []string{sdn.vpcResource().Group}, Resources: []string{sdn.vpcResource().Resource}, Verbs: []string{"get", "list", "watch", "create", "delete"}},
+			}
+		},
+		mutator: workspaceMutator,
+	},
+}
+
+// 注入固定ip时查询namespace的子网，leader监听网关的删除记录不再固定的ip
+// 网关独占固定ip的sdn还需要创建和释放预留，并跳过已经分配给pod的地址
+func fixedIPRules(gvr schema.GroupVersionResource) func(sdn sdnBackend) []rbacv1.PolicyRule {
+	return func(sdn sdnBackend) []rbacv1.PolicyRule {
+		rules := []rbacv1.PolicyRule{
+			{APIGroups: []string{sdn.subnetResource().Group}, Resources: []string{sdn.subnetResource().Resource}, Verbs: []string{"get", "list", "watch"}},
+			{APIGroups: []string{gvr.Group}, Resources: []string{gvr.Resource}, Verbs: []string{"get", "list", "watch"}},
+		}
+		if reserver, ok := sdn.(fixedIPReserver); ok {
+			reservation := reserver.reservationResource()
+			rules = append(rules,
+				rbacv1.PolicyRule{APIGroups: []string{reservation.Group}, Resources: []string{reservation.Resource}, Verbs: []string{"get", "list", "watch", "create", "delete"}},
+				rbacv1.PolicyRule{APIGroups: []string{podGVR.Group}, Resources: []string{podGVR.Resource}, Verbs: []string{"get", "list", "watch"}},
+			)
+		}
+		return rules
+	}
+}
+
+// 所有处理器都需要的权限：策略匹配时查询namespace和WebhookPolicy
+var commonRules = []rbacv1.PolicyRule{
+	{APIGroups: []string{""}, Resources: []string{"namespaces"}, Verbs: []string{"get", "list", "watch"}},
+	{APIGroups: []string{webhookPolicyGVR.Group}, Resources: []string{webhookPolicyGVR.Resource}, Verbs: []string{"get", "list", "watch"}},
+}
+
+var allFeatures = sliceFlag{string(featureVpcLabel), string(featureFixedIPs), string(featureVpcLifecycle)}
+
+func handlerForGVR(gvr schema.GroupVersionResource) (handlerSpec, bool) {
+	for _, h := range admissionHandlers {
+		if h.gvr == gvr {
+			return h, true
+		}
+	}
+	return handlerSpec{}, false
+}
+
+func handlerForKind(kind string) (handlerSpec, bool) {
+	for _, h := range admissionHandlers {
+		if h.kind == kind {
+			return h, true
+		}
+	}
+	return handlerSpec{}, false
+}
+
+// 按GroupVersionKind和操作查找处理器
+func lookupHandler(gvk schema.GroupVersionKind, op v1.Operation) (handlerSpec, bool) {
+	for _, h := range admissionHandlers {
+		if h.gvk() == gvk && h.handles(op) {
+			return h, true
+		}
+	}
+	return handlerSpec{}, false
+}
+
+// -handlers中使用资源名，例如namespaces、deployments
+func handlerForResource(resource string) (handlerSpec, bool) {
+	for _, h := range admissionHandlers {
+		if h.gvr.Resource == resource {
+			return h, true
+		}
+	}
+	return handlerSpec{}, false
+}
+
+func checkHandlers(handlers sliceFlag) error {
+	for _, name := range handlers {
+		if _, ok := handlerForResource(name); !ok {
+			return fmt.Errorf("unknown handler %q", name)
+		}
+	}
+	return nil
+}
+
+// 处理器需要所属的功能开启，并且在-handlers中(为空时启用所有处理器)
+func handlerEnabled(h handlerSpec, features, handlers sliceFlag) bool {
+	return features.has(string(h.feature)) && (len(handlers) == 0 || handlers.has(h.gvr.Resource))
+}
+
+// 按开启的功能和处理器筛选
+func enabledHandlers(features, handlers sliceFlag) []handlerSpec {
+	var enabled []handlerSpec
+	for _, h := range admissionHandlers {
+		if handlerEnabled(h, features, handlers) {
+			enabled = append(enabled, h)
+		}
+	}
+	return enabled
+}
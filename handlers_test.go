@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "k8s.io/api/admission/v1"
+)
+
+func TestHandlerRoutes(t *testing.T) {
+	body, err := os.ReadFile(filepath.Join("testdata", "requests", "namespace-prefixed.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsupported, err := os.ReadFile(filepath.Join("testdata", "requests", "unsupported-kind.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name         string
+		path         string
+		body         []byte
+		handlers     sliceFlag
+		unregistered failureMode
+		allowed      bool
+		patched      bool
+	}{
+		{name: "shared path", path: "/mutate", body: body, allowed: true, patched: true},
+		{name: "own path", path: "/mutate/namespaces", body: body, allowed: true, patched: true},
+		{name: "other handler's path", path: "/mutate/deployments", body: body},
+		{name: "other handler's path allowed", path: "/mutate/deployments", body: body, unregistered: failureModeAllow, allowed: true},
+		{name: "unregistered kind", path: "/mutate", body: unsupported},
+		{name: "unregistered kind allowed", path: "/mutate", body: unsupported, unregistered: failureModeAllow, allowed: true},
+		{name: "handler disabled", path: "/mutate/namespaces", body: body, handlers: sliceFlag{"deployments"}, allowed: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			whsvr, _ := newTestServer(t, "k8s-poc")
+			whsvr.handlers = c.handlers
+			whsvr.unregisteredKinds = c.unregistered
+
+			result := toGolden(t, admitPath(t, whsvr, c.path, c.body), nil)
+			if result.Allowed != c.allowed || (len(result.Patch) > 0) != c.patched {
+				t.Errorf("allowed %v, patch %s, message %q", result.Allowed, result.Patch, result.Message)
+			}
+		})
+	}
+}
+
+func TestLookupHandler(t *testing.T) {
+	for _, h := range admissionHandlers {
+		for _, op := range h.operations {
+			found, ok := lookupHandler(h.gvk(), v1.Operation(op))
+			if !ok || found.path() != h.path() {
+				t.Errorf("%s %s resolved to %q", h.gvk(), op, found.path())
+			}
+		}
+	}
+	// pod只在创建时处理
+	if _, ok := lookupHandler(podGVR.GroupVersion().WithKind("Pod"), "UPDATE"); ok {
+		t.Error("pod updates should not be registered")
+	}
+	if err := checkHandlers(sliceFlag{"namespaces", "bogus"}); err == nil {
+		t.Error("expected an error for an unknown handler")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// 选主参数，多副本时后台任务只在leader上运行，准入服务所有副本都提供
+type leaderElectionParameters struct {
+	enabled       bool
+	namespace     string
+	name          string
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+}
+
+// 只能有一个实例运行的后台任务，ctx取消(失去leader)后必须尽快返回
+type backgroundController struct {
+	name string
+	run  func(ctx context.Context)
+}
+
+// pod所在的namespace，通过downward API注入
+func leaderElectionNamespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	return "kube-system"
+}
+
+// 当前副本在Lease中的标识，pod中hostname即pod名，加随机后缀避免重启后与旧记录冲突
+func leaderIdentity() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "ks-webhook-controller"
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return hostname
+	}
+	return hostname + "_" + hex.EncodeToString(suffix)
+}
+
+// 参与选主直到ctx取消，失去leader后重新竞选，不影响准入服务
+func runLeaderElection(ctx context.Context, kubeClient kubernetes.Interface, parameters leaderElectionParameters, identity string, controllers []backgroundController) error {
+	if !parameters.enabled {
+		glog.Infof("Leader election disabled, running %d background controllers", len(controllers))
+		runControllers(ctx, controllers)
+		return nil
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      parameters.name,
+			Namespace: parameters.namespace,
+		},
+		Client:     kubeClient.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   parameters.leaseDuration,
+		RenewDeadline:   parameters.renewDeadline,
+		RetryPeriod:     parameters.retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            parameters.name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				glog.Infof("%s became leader of %s/%s, starting %d background controllers", identity, parameters.namespace, parameters.name, len(controllers))
+				runControllers(ctx, controllers)
+			},
+			OnStoppedLeading: func() {
+				glog.Infof("%s is not leading %s/%s", identity, parameters.namespace, parameters.name)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					glog.Infof("Current leader of %s/%s: %s", parameters.namespace, parameters.name, leader)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+	}
+	return nil
+}
+
+// 并发运行所有后台任务，全部返回后才返回
+func runControllers(ctx context.Context, controllers []backgroundController) {
+	var wg sync.WaitGroup
+	for _, c := range controllers {
+		wg.Add(1)
+		go func(c backgroundController) {
+			defer wg.Done()
+			glog.Infof("Starting background controller %s", c.name)
+			c.run(ctx)
+			glog.Infof("Stopped background controller %s", c.name)
+		}(c)
+	}
+	wg.Wait()
+}
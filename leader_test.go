@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLeaderElectionRunsControllersOnce(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset()
+	parameters := leaderElectionParameters{
+		enabled:       true,
+		namespace:     "kube-system",
+		name:          "ks-webhook-controller",
+		leaseDuration: 2 * time.Second,
+		renewDeadline: time.Second,
+		retryPeriod:   100 * time.Millisecond,
+	}
+
+	var running int32
+	leading := make(chan string, 2)
+	controller := func(identity string) []backgroundController {
+		return []backgroundController{{
+			name: "test",
+			run: func(ctx context.Context) {
+				if atomic.AddInt32(&running, 1) > 1 {
+					t.Errorf("%s started while another replica is leading", identity)
+				}
+				leading <- identity
+				<-ctx.Done()
+				atomic.AddInt32(&running, -1)
+			},
+		}}
+	}
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	doneA := make(chan struct{})
+	go func() {
+		defer close(doneA)
+		if err := runLeaderElection(ctxA, kubeClient, parameters, "a", controller("a")); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	select {
+	case id := <-leading:
+		if id != "a" {
+			t.Fatalf("unexpected leader %s", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a did not become leader")
+	}
+
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+	go runLeaderElection(ctxB, kubeClient, parameters, "b", controller("b"))
+
+	select {
+	case id := <-leading:
+		t.Fatalf("%s became leader while a holds the lease", id)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// a退出时释放Lease，b应在retryPeriod内接管
+	cancelA()
+	<-doneA
+	select {
+	case id := <-leading:
+		if id != "b" {
+			t.Fatalf("unexpected leader %s", id)
+		}
+	case <-time.After(parameters.leaseDuration):
+		t.Fatal("b did not take over the released lease")
+	}
+}
+
+func TestLeaderElectionDisabled(t *testing.T) {
+	ran := false
+	err := runLeaderElection(context.Background(), nil, leaderElectionParameters{}, "a", []backgroundController{
+		{name: "test", run: func(ctx context.Context) { ran = true }},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ran {
+		t.Error("controllers should run directly when leader election is disabled")
+	}
+}
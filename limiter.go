@@ -0,0 +1,81 @@
+package main
+
+import (
+	"expvar"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// 超过限制的原因，写入提示信息和统计
+const (
+	limitConcurrency = "concurrency"
+	limitRate        = "rate"
+)
+
+// 限制同时处理的请求数和每秒接受的请求数，超过限制时立即拒绝而不排队
+type admissionLimiter struct {
+	// 为nil时不限制
+	inflight chan struct{}
+	rate     flowcontrol.RateLimiter
+	// 通过/debug/vars输出的当前并发数、限制和拒绝次数
+	stats *expvar.Map
+}
+
+// maxInflight或qps不大于0时不做对应的限制
+func newAdmissionLimiter(maxInflight int, qps float64, burst int) *admissionLimiter {
+	l := &admissionLimiter{stats: new(expvar.Map).Init()}
+	if maxInflight > 0 {
+		l.inflight = make(chan struct{}, maxInflight)
+	}
+	if qps > 0 {
+		l.rate = flowcontrol.NewTokenBucketRateLimiter(float32(qps), burst)
+	}
+
+	limits := new(expvar.Map).Init()
+	limits.Add("maxInflight", int64(maxInflight))
+	limits.AddFloat("qps", qps)
+	limits.Add("burst", int64(burst))
+	l.stats.Set("limits", limits)
+	l.stats.Add("inflight", 0)
+	l.stats.Add("admitted", 0)
+	l.stats.Add("rejected_"+limitConcurrency, 0)
+	l.stats.Add("rejected_"+limitRate, 0)
+	return l
+}
+
+// 返回释放函数，超过限制时返回被触发的限制
+func (l *admissionLimiter) acquire() (func(), string) {
+	if l == nil {
+		return func() {}, ""
+	}
+
+	if l.inflight != nil {
+		select {
+		case l.inflight <- struct{}{}:
+		default:
+			return nil, l.reject(limitConcurrency)
+		}
+	}
+	if l.rate != nil && !l.rate.TryAccept() {
+		if l.inflight != nil {
+			<-l.inflight
+		}
+		return nil, l.reject(limitRate)
+	}
+
+	l.stats.Add("admitted", 1)
+	l.stats.Add("inflight", 1)
+	return func() {
+		l.stats.Add("inflight", -1)
+		if l.inflight != nil {
+			<-l.inflight
+		}
+	}, ""
+}
+
+func (l *admissionLimiter) reject(limit string) string {
+	l.stats.Add("rejected_"+limit, 1)
+	glog.Warningf("Rejecting admission request, %s limit reached", limit)
+	return limit
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAdmissionLimiter(t *testing.T) {
+	l := newAdmissionLimiter(2, 0, 0)
+	release1, limit := l.acquire()
+	if limit != "" {
+		t.Fatalf("rejected by %s", limit)
+	}
+	if _, limit := l.acquire(); limit != "" {
+		t.Fatalf("rejected by %s", limit)
+	}
+	if _, limit := l.acquire(); limit != limitConcurrency {
+		t.Fatalf("expected the concurrency limit, got %q", limit)
+	}
+	release1()
+	if _, limit := l.acquire(); limit != "" {
+		t.Fatalf("rejected after release by %s", limit)
+	}
+	if got := l.stats.Get("rejected_" + limitConcurrency).String(); got != "1" {
+		t.Errorf("rejected_concurrency = %s", got)
+	}
+	if got := l.stats.Get("inflight").String(); got != "2" {
+		t.Errorf("inflight = %s", got)
+	}
+
+	// 令牌用完后立即拒绝，不占用并发数
+	l = newAdmissionLimiter(1, 0.001, 1)
+	release, limit := l.acquire()
+	if limit != "" {
+		t.Fatalf("rejected by %s", limit)
+	}
+	release()
+	if _, limit := l.acquire(); limit != limitRate {
+		t.Fatalf("expected the rate limit, got %q", limit)
+	}
+	if len(l.inflight) != 0 {
+		t.Errorf("rate limited request holds a slot")
+	}
+
+	var unlimited *admissionLimiter
+	if _, limit := unlimited.acquire(); limit != "" {
+		t.Errorf("nil limiter rejected by %s", limit)
+	}
+}
+
+// 超过限制的请求按依赖不可用处理，failure-mode为allow时放行
+func TestServeOverloaded(t *testing.T) {
+	body, err := os.ReadFile(filepath.Join("testdata", "requests", "namespace-prefixed.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	whsvr, _ := newTestServer(t, "k8s-poc")
+	whsvr.limiter = newAdmissionLimiter(1, 0, 0)
+	whsvr.limiter.inflight <- struct{}{}
+
+	result := toGolden(t, admit(t, whsvr, body), nil)
+	if result.Allowed || result.Code != 503 {
+		t.Errorf("expected an overloaded denial, got %+v", result)
+	}
+
+	if err := whsvr.failureModes.Set("Namespace=allow"); err != nil {
+		t.Fatal(err)
+	}
+	result = toGolden(t, admit(t, whsvr, body), nil)
+	if !result.Allowed || len(result.Patch) > 0 {
+		t.Errorf("expected the overloaded request to be allowed unchanged, got %+v", result)
+	}
+}
@@ -3,26 +3,74 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"expvar"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 )
 
 func main() {
+	// 子命令
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "simulate":
+			os.Exit(runSimulate(os.Args[2:]))
+		case "manifests":
+			os.Exit(runManifests(os.Args[2:]))
+		case "report":
+			os.Exit(runReport(os.Args[2:]))
+		case "backfill":
+			os.Exit(runBackfill(os.Args[2:]))
+		}
+	}
+
 	var parameters WhSvrParameters
 
 	// get command line parameters
 	flag.IntVar(&parameters.port, "port", 443, "Webhook server port.")
+	flag.IntVar(&parameters.metricsPort, "metrics-port", 0, "Plain HTTP port serving /debug/vars and /report, apart from the admission port. Keep it inside the cluster. 0 disables it.")
 	flag.StringVar(&parameters.certFile, "tlsCertFile", "/etc/webhook/certs/cert.crt", "File containing the x509 Certificate for HTTPS.")
 	flag.StringVar(&parameters.keyFile, "tlsKeyFile", "/etc/webhook/certs/key.key", "File containing the x509 private key to --tlsCertFile.")
+	flag.StringVar(&parameters.tls.clientCA, "tls-client-ca", "", "PEM file with the CA that signs the kube-apiserver's client certificate. When set, clients without a certificate from it are rejected.")
+	flag.Var(&parameters.tls.clientNames, "tls-client-names", "Common or DNS names of the accepted client certificates, for example: kube-apiserver. Empty accepts every certificate signed by -tls-client-ca.")
+	flag.StringVar(&parameters.tls.minVersion, "tls-min-version", "1.2", "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3.")
+	flag.Var(&parameters.tls.cipherSuites, "tls-cipher-suites", "Cipher suites for TLS 1.2 and below, for example: TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Empty uses the Go defaults.")
 	flag.StringVar(&parameters.vpcprefix, "vpcprefix", "default", "vpcprefix")
 	flag.StringVar(&parameters.cluster, "cluster", "poc", "cluster")
 	flag.Var(&parameters.workspaces, "ws", "abnormal workspaces,for example:shanlv,tuangou")
+	flag.StringVar(&parameters.locale, "locale", "zh", "Default locale of user-facing messages: zh or en.")
+	flag.StringVar(&parameters.kubeconfig, "kubeconfig", "", "Path to a kubeconfig. Only required if out-of-cluster.")
+	parameters.features = allFeatures
+	flag.Var(&parameters.features, "features", "Enabled features: vpcLabel,fixedIPs,vpcLifecycle")
+	flag.DurationVar(&parameters.timeout, "timeout", 10*time.Second, "Webhook timeoutSeconds, bounds the API calls made while handling a request.")
+	flag.Var(&parameters.handlers, "handlers", "Enabled handlers by resource, for example: namespaces,deployments,workspaces. Empty enables every handler of the enabled features.")
+	flag.StringVar(&parameters.unregistered, "unregistered-kinds", string(failureModeDeny), "Whether requests for kinds and operations without a handler are allowed or denied: allow or deny.")
+	flag.IntVar(&parameters.maxInflight, "max-inflight", 64, "Admission requests handled at the same time. Requests above it are rejected at once as overloaded. 0 disables the limit.")
+	flag.Float64Var(&parameters.qps, "qps", 0, "Admission requests accepted per second. Requests above it are rejected at once as overloaded. 0 disables the limit.")
+	flag.IntVar(&parameters.burst, "burst", 100, "Admission requests accepted in a burst above -qps.")
+	flag.Var(&parameters.failureModes, "failure-mode", "Per kind behavior when dependencies are unavailable, for example: Deployment=allow,Namespace=deny. Unlisted kinds are denied.")
+	flag.StringVar(&parameters.sdn, "sdn", "yunshan", "SDN backing VPCs and subnets: yunshan, kube-ovn or calico.")
+	flag.Var(&parameters.vpcOverride.adminGroups, "vpc-override-groups", "Groups allowed to set the VPC of a namespace with the "+vpcOverrideAnnotation+" annotation, for example: platform-admins. Empty denies every override.")
+	flag.Var(&parameters.vpcOverride.vpcs, "vpc-override-vpcs", "VPCs a namespace may be moved to with the "+vpcOverrideAnnotation+" annotation. Empty denies every override.")
+	flag.StringVar(&parameters.vpcTemplates, "vpc-templates", "", "File with the VPC spec templates selected per workspace.")
+	flag.Var(&parameters.subnets.supernets, "subnet-supernets", "Supernet each VPC carves namespace subnets from, for example: k8s-poc-a=10.64.0.0/16,*=10.96.0.0/12. Empty disables subnet provisioning.")
+	flag.IntVar(&parameters.subnets.prefixLength, "subnet-prefix-length", 24, "Prefix length of the subnet allocated to each namespace.")
+	flag.StringVar(&parameters.subnets.configMap, "subnet-allocation-configmap", "ks-webhook-subnet-allocations", "ConfigMap recording which block went to which namespace, in the leader election namespace.")
+	flag.DurationVar(&parameters.subnets.resync, "subnet-resync", 10*time.Minute, "Interval at which every namespace is reconciled again.")
+	flag.BoolVar(&parameters.reportEndpoint, "report-endpoint", false, "Serve the drift report of workspace, namespace and VPC bindings on /report of -metrics-port.")
+	flag.StringVar(&parameters.auditLog, "audit-log", "", "File the subnet and fixed IP releases and unpinned fixed IPs are appended to as JSON lines. Empty writes them to the log.")
+	flag.BoolVar(&parameters.leaderElection.enabled, "leader-elect", true, "Elect a leader before running background controllers, required with more than one replica.")
+	flag.StringVar(&parameters.leaderElection.namespace, "leader-elect-namespace", leaderElectionNamespace(), "Namespace of the leader election Lease.")
+	flag.StringVar(&parameters.leaderElection.name, "leader-elect-name", "ks-webhook-controller", "Name of the leader election Lease.")
+	flag.DurationVar(&parameters.leaderElection.leaseDuration, "leader-elect-lease-duration", 15*time.Second, "Duration non-leaders wait before trying to take over the Lease.")
+	flag.DurationVar(&parameters.leaderElection.renewDeadline, "leader-elect-renew-deadline", 10*time.Second, "Duration the leader retries renewing the Lease before giving up.")
+	flag.DurationVar(&parameters.leaderElection.retryPeriod, "leader-elect-retry-period", 2*time.Second, "Interval between Lease acquire or renew attempts.")
 	flag.Parse()
 
 	if parameters.vpcprefix == " " {
@@ -33,26 +81,114 @@ func main() {
 		glog.Errorf("'cluster'选项不支持空串!!!")
 	}
 
+	if loc, ok := parseLocale(parameters.locale); ok {
+		defaultLocale = loc
+	} else {
+		glog.Errorf("'locale'选项不支持: %v", parameters.locale)
+	}
+
+	if err := checkHandlers(parameters.handlers); err != nil {
+		glog.Fatalf("Failed to enable handlers: %v", err)
+	}
+	unregisteredKinds := failureMode(parameters.unregistered)
+	if unregisteredKinds != failureModeAllow && unregisteredKinds != failureModeDeny {
+		glog.Fatalf("'unregistered-kinds'选项不支持: %v", parameters.unregistered)
+	}
+
+	if parameters.reportEndpoint && parameters.metricsPort <= 0 {
+		glog.Fatalf("'report-endpoint'选项需要设置'metrics-port'")
+	}
+
+	if parameters.qps > 0 && parameters.burst <= 0 {
+		glog.Fatalf("'burst'选项必须大于0: %v", parameters.burst)
+	}
+
 	pair, err := tls.LoadX509KeyPair(parameters.certFile, parameters.keyFile)
 	if err != nil {
 		glog.Errorf("Failed to load key pair: %v", err)
 	}
 
+	tlsConfig, err := newTLSConfig(parameters.tls, []tls.Certificate{pair})
+	if err != nil {
+		glog.Fatalf("Failed to configure TLS: %v", err)
+	}
+
+	vpcTemplates, err := loadVpcTemplates(parameters.vpcTemplates)
+	if err != nil {
+		glog.Fatalf("Failed to load vpc templates: %v", err)
+	}
+
+	backend, err := sdnBackendByName(parameters.sdn)
+	if err != nil {
+		glog.Fatalf("Failed to select sdn: %v", err)
+	}
+	if len(parameters.subnets.supernets) > 0 {
+		if _, err := subnetProvisionerOf(backend); err != nil {
+			glog.Fatalf("Failed to enable subnet provisioning: %v", err)
+		}
+	}
+
+	client, err := newClient(parameters.kubeconfig)
+	if err != nil {
+		glog.Fatalf("Failed to create kubernetes client: %v", err)
+	}
+	client.sdn = backend
+	if err := checkSDNResources(client.kubeClient.Discovery(), backend); err != nil {
+		glog.Fatalf("Failed to find the resources of sdn %s: %v", parameters.sdn, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	// 每个副本都需要处理请求，策略和namespace缓存不依赖leader
+	client.cache = startPolicyCache(ctx, client.dynamicClient, backend)
+
 	whsvr := &WebhookServer{
 		server: &http.Server{
 			Addr:      fmt.Sprintf(":%v", parameters.port),
-			TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}},
+			TLSConfig: tlsConfig,
+			ErrorLog:  serverErrorLog(),
 		},
-		vpcprefix:  parameters.vpcprefix,
-		abnormalws: parameters.workspaces,
-		cluster:    parameters.cluster,
+		vpcprefix:    parameters.vpcprefix,
+		abnormalws:   parameters.workspaces,
+		cluster:      parameters.cluster,
+		locale:       defaultLocale,
+		features:     parameters.features,
+		client:       client,
+		timeout:      parameters.timeout,
+		failureModes: parameters.failureModes,
+		vpcTemplates: vpcTemplates,
+		handlers:     parameters.handlers,
+		limiter:      newAdmissionLimiter(parameters.maxInflight, parameters.qps, parameters.burst),
+
+		unregisteredKinds: unregisteredKinds,
+		vpcOverride:       parameters.vpcOverride,
 	}
 
 	// define http server and server handler
 	mux := http.NewServeMux()
-	mux.HandleFunc("/mutate", whsvr.serve)
+	whsvr.registerRoutes(mux)
 	whsvr.server.Handler = mux
 
+	// 运行时统计包含启动参数和内存信息，报告包含所有业务空间的绑定关系，都不在准入端口上提供
+	var metricsServer *http.Server
+	if parameters.metricsPort > 0 {
+		metrics := http.NewServeMux()
+		// 并发和速率限制的统计
+		expvar.Publish("admissionLimiter", whsvr.limiter.stats)
+		metrics.Handle("/debug/vars", expvar.Handler())
+		if parameters.reportEndpoint {
+			metrics.HandleFunc("/report", whsvr.serveReport)
+		}
+		metricsServer = &http.Server{
+			Addr:     fmt.Sprintf(":%v", parameters.metricsPort),
+			Handler:  metrics,
+			ErrorLog: serverErrorLog(),
+		}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				glog.Errorf("Failed to listen and serve metrics server: %v", err)
+			}
+		}()
+	}
+
 	// start webhook server in new routine
 	go func() {
 		if err := whsvr.server.ListenAndServeTLS("", ""); err != nil {
@@ -62,6 +198,32 @@ func main() {
 
 	glog.Info("Server started")
 
+	// 后台任务只在leader上运行
+	audit, err := newAuditLogger(parameters.auditLog)
+	if err != nil {
+		glog.Fatalf("Failed to open audit log: %v", err)
+	}
+	var controllers []backgroundController
+	if len(parameters.subnets.supernets) > 0 {
+		subnets := newSubnetController(client, parameters.subnets, parameters.leaderElection.namespace, audit)
+		controllers = append(controllers, backgroundController{name: "subnet", run: subnets.run})
+	}
+	if membership, ok := backend.(vpcMembership); ok && parameters.features.has(string(featureVpcLabel)) {
+		vpcs := &vpcMembershipController{client: client, membership: membership, resync: parameters.subnets.resync}
+		controllers = append(controllers, backgroundController{name: "vpc-membership", run: vpcs.run})
+	}
+	if parameters.features.has(string(featureFixedIPs)) {
+		fixedIPs := &fixedIPController{client: client, audit: audit, resync: parameters.subnets.resync}
+		controllers = append(controllers, backgroundController{name: "fixed-ip", run: fixedIPs.run})
+	}
+	electionDone := make(chan struct{})
+	go func() {
+		defer close(electionDone)
+		if err := runLeaderElection(ctx, client.kubeClient, parameters.leaderElection, leaderIdentity(), controllers); err != nil {
+			glog.Errorf("Failed to run leader election: %v", err)
+		}
+	}()
+
 	// listening OS shutdown singal
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
@@ -69,4 +231,11 @@ func main() {
 
 	glog.Infof("Got OS shutdown signal, shutting down webhook server gracefully...")
 	whsvr.server.Shutdown(context.Background())
+	if metricsServer != nil {
+		metricsServer.Shutdown(context.Background())
+	}
+
+	// 等待释放Lease，其他副本可以立即接管
+	cancel()
+	<-electionDone
 }
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/yaml"
+)
+
+// manifests子命令的参数
+type manifestsParameters struct {
+	namespace      string
+	name           string
+	image          string
+	replicas       int
+	caFile         string // webhook证书的CA，写入caBundle
+	failurePolicy  string
+	timeoutSeconds int
+	vpcprefix      string
+	cluster        string
+	workspaces     sliceFlag
+	locale         string
+	features       sliceFlag
+	handlers       sliceFlag
+	failureModes   failureModes
+	vpcTemplates   string // 保存vpc模板的ConfigMap，挂载到容器中
+	supernets      supernets
+	prefixLength   int
+	sdn            string
+	unregistered   string
+	maxInflight    int
+	qps            float64
+	burst          int
+	vpcOverride    vpcOverridePolicy
+	auditLog       string // 审计日志路径，所在目录挂载emptyDir
+	reportEndpoint bool
+	metricsPort    int           // 容器暴露的metrics端口，不加入webhook的Service
+	clientCA       string        // 保存客户端CA的ConfigMap，挂载到容器中
+	tls            tlsParameters // 不使用其中的clientCA，由上面的ConfigMap提供
+	only           string        // 只输出某一类清单: webhook、rbac、deployment或service
+}
+
+// 根据实际开启的处理器和功能生成部署清单，保证清单与二进制一致
+func runManifests(args []string) int {
+	parameters, err := parseManifestsFlags(args)
+	if err != nil {
+		return 2
+	}
+
+	objects, err := renderManifests(parameters)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "manifests: %v\n", err)
+		return 1
+	}
+	if err := writeManifests(os.Stdout, objects); err != nil {
+		fmt.Fprintf(os.Stderr, "manifests: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func parseManifestsFlags(args []string) (manifestsParameters, error) {
+	var parameters manifestsParameters
+
+	fs := flag.NewFlagSet("manifests", flag.ContinueOnError)
+	fs.StringVar(&parameters.namespace, "namespace", "kube-system", "Namespace the webhook is deployed in.")
+	fs.StringVar(&parameters.name, "name", "ks-webhook-controller", "Base name of the webhook resources.")
+	fs.StringVar(&parameters.image, "image", "repos.cloud.cmft/wu/ks-webhook-controller:v1.7", "Webhook image.")
+	fs.IntVar(&parameters.replicas, "replicas", 2, "Webhook replicas.")
+	fs.StringVar(&parameters.caFile, "ca-file", "", "PEM file with the CA that signed the serving certificate, written into caBundle.")
+	fs.StringVar(&parameters.failurePolicy, "failure-policy", string(admissionregistrationv1.Fail), "Webhook failurePolicy: Fail or Ignore.")
+	fs.IntVar(&parameters.timeoutSeconds, "timeout-seconds", 10, "Webhook timeoutSeconds.")
+	fs.StringVar(&parameters.vpcprefix, "vpcprefix", "default", "vpcprefix")
+	fs.StringVar(&parameters.cluster, "cluster", "poc", "cluster")
+	fs.Var(&parameters.workspaces, "ws", "abnormal workspaces,for example:shanlv,tuangou")
+	fs.StringVar(&parameters.locale, "locale", "zh", "Default locale of user-facing messages: zh or en.")
+	parameters.features = allFeatures
+	fs.Var(&parameters.features, "features", "Enabled features: vpcLabel,fixedIPs,vpcLifecycle")
+	fs.Var(&parameters.handlers, "handlers", "Enabled handlers by resource, for example: namespaces,deployments,workspaces. Empty enables every handler of the enabled features.")
+	fs.Var(&parameters.failureModes, "failure-mode", "Per kind behavior when dependencies are unavailable, for example: Deployment=allow,Namespace=deny.")
+	fs.StringVar(&parameters.vpcTemplates, "vpc-templates-configmap", "", "ConfigMap with the VPC spec templates under the key "+vpcTemplatesKey+", mounted into the webhook.")
+	fs.Var(&parameters.supernets, "subnet-supernets", "Supernet each VPC carves namespace subnets from, for example: k8s-poc-a=10.64.0.0/16,*=10.96.0.0/12.")
+	fs.IntVar(&parameters.prefixLength, "subnet-prefix-length", 24, "Prefix length of the subnet allocated to each namespace.")
+	fs.StringVar(&parameters.sdn, "sdn", "yunshan", "SDN backing VPCs and subnets: yunshan, kube-ovn or calico.")
+	fs.StringVar(&parameters.unregistered, "unregistered-kinds", string(failureModeDeny), "Whether requests for kinds and operations without a handler are allowed or denied: allow or deny.")
+	fs.IntVar(&parameters.maxInflight, "max-inflight", 64, "Admission requests handled at the same time. 0 disables the limit.")
+	fs.Float64Var(&parameters.qps, "qps", 0, "Admission requests accepted per second. 0 disables the limit.")
+	fs.IntVar(&parameters.burst, "burst", 100, "Admission requests accepted in a burst above -qps.")
+	fs.Var(&parameters.vpcOverride.adminGroups, "vpc-override-groups", "Groups allowed to set the VPC of a namespace with the "+vpcOverrideAnnotation+" annotation.")
+	fs.Var(&parameters.vpcOverride.vpcs, "vpc-override-vpcs", "VPCs a namespace may be moved to with the "+vpcOverrideAnnotation+" annotation.")
+	fs.StringVar(&parameters.auditLog, "audit-log", "", "File in the container the releases are appended to, its directory is mounted as an emptyDir. Empty writes them to the log.")
+	fs.BoolVar(&parameters.reportEndpoint, "report-endpoint", false, "Serve the drift report on /report of -metrics-port.")
+	fs.IntVar(&parameters.metricsPort, "metrics-port", 0, "Plain HTTP port serving /debug/vars and /report, exposed on the container only. 0 disables it.")
+	fs.StringVar(&parameters.clientCA, "tls-client-ca-configmap", "", "ConfigMap with the CA of the kube-apiserver's client certificate under the key "+clientCAKey+", mounted into the webhook.")
+	fs.Var(&parameters.tls.clientNames, "tls-client-names", "Common or DNS names of the accepted client certificates, for example: kube-apiserver.")
+	fs.StringVar(&parameters.tls.minVersion, "tls-min-version", "1.2", "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3.")
+	fs.Var(&parameters.tls.cipherSuites, "tls-cipher-suites", "Cipher suites for TLS 1.2 and below. Empty uses the Go defaults.")
+	fs.StringVar(&parameters.only, "only", "", "Only render one group: webhook, rbac, deployment or service.")
+	err := fs.Parse(args)
+	return parameters, err
+}
+
+func renderManifests(parameters manifestsParameters) ([]runtime.Object, error) {
+	for _, f := range parameters.features {
+		if !allFeatures.has(f) {
+			return nil, fmt.Errorf("unknown feature %q", f)
+		}
+	}
+	if err := checkHandlers(parameters.handlers); err != nil {
+		return nil, err
+	}
+
+	backend, err := sdnBackendByName(parameters.sdn)
+	if err != nil {
+		return nil, err
+	}
+	if len(parameters.supernets) > 0 {
+		if _, err := subnetProvisionerOf(backend); err != nil {
+			return nil, err
+		}
+	}
+	if unregistered := failureMode(parameters.unregistered); unregistered != failureModeAllow && unregistered != failureModeDeny {
+		return nil, fmt.Errorf("unknown unregistered-kinds %q", parameters.unregistered)
+	}
+	if parameters.qps > 0 && parameters.burst <= 0 {
+		return nil, fmt.Errorf("burst must be greater than 0 with qps, got %d", parameters.burst)
+	}
+	if _, err := newTLSConfig(tlsParameters{minVersion: parameters.tls.minVersion, cipherSuites: parameters.tls.cipherSuites}, nil); err != nil {
+		return nil, err
+	}
+	if len(parameters.tls.clientNames) > 0 && parameters.clientCA == "" {
+		return nil, fmt.Errorf("tls-client-names requires tls-client-ca-configmap")
+	}
+	if parameters.auditLog != "" && !path.IsAbs(parameters.auditLog) {
+		return nil, fmt.Errorf("audit-log must be an absolute path in the container, got %q", parameters.auditLog)
+	}
+	if parameters.reportEndpoint && parameters.metricsPort <= 0 {
+		return nil, fmt.Errorf("report-endpoint requires metrics-port")
+	}
+
+	var objects []runtime.Object
+	if parameters.only == "" || parameters.only == "webhook" {
+		webhook, err := renderWebhookConfiguration(parameters)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, webhook)
+	}
+	if parameters.only == "" || parameters.only == "rbac" {
+		objects = append(objects, renderRBAC(parameters, backend)...)
+	}
+	if parameters.only == "" || parameters.only == "deployment" {
+		objects = append(objects, renderDeployment(parameters))
+	}
+	if parameters.only == "" || parameters.only == "service" {
+		objects = append(objects, renderService(parameters))
+	}
+	if len(objects) == 0 {
+		return nil, fmt.Errorf("unknown manifest group %q", parameters.only)
+	}
+	return objects, nil
+}
+
+// 输出多文档YAML，去掉creationTimestamp和status等空字段
+func writeManifests(out io.Writer, objects []runtime.Object) error {
+	for i, obj := range objects {
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		if err != nil {
+			return err
+		}
+		unstructured.RemoveNestedField(content, "metadata", "creationTimestamp")
+		unstructured.RemoveNestedField(content, "spec", "template", "metadata", "creationTimestamp")
+		unstructured.RemoveNestedField(content, "status")
+
+		data, err := yaml.Marshal(content)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			if _, err := io.WriteString(out, "---\n"); err != nil {
+				return err
+			}
+		}
+		if _, err := out.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func manifestLabels(parameters manifestsParameters) map[string]string {
+	return map[string]string{"app": parameters.name}
+}
+
+// 每个处理器一个webhook，通过各自的路径访问，修改其他资源的处理器需要单独声明sideEffects
+func renderWebhookConfiguration(parameters manifestsParameters) (*admissionregistrationv1.MutatingWebhookConfiguration, error) {
+	var caBundle []byte
+	if parameters.caFile != "" {
+		data, err := os.ReadFile(parameters.caFile)
+		if err != nil {
+			return nil, err
+		}
+		caBundle = data
+	}
+
+	failurePolicy := admissionregistrationv1.FailurePolicyType(parameters.failurePolicy)
+	if failurePolicy != admissionregistrationv1.Fail && failurePolicy != admissionregistrationv1.Ignore {
+		return nil, fmt.Errorf("unknown failure policy %q", parameters.failurePolicy)
+	}
+	timeoutSeconds := int32(parameters.timeoutSeconds)
+
+	webhook := func(h handlerSpec) admissionregistrationv1.MutatingWebhook {
+		path := h.path()
+		sideEffects := admissionregistrationv1.SideEffectClassNone
+		if h.sideEffects {
+			sideEffects = admissionregistrationv1.SideEffectClassNoneOnDryRun
+		}
+		rules := []admissionregistrationv1.RuleWithOperations{
+			{
+				Operations: h.operations,
+				Rule: admissionregistrationv1.Rule{
+					APIGroups:   []string{h.gvr.Group},
+					APIVersions: []string{h.gvr.Version},
+					Resources:   []string{h.gvr.Resource},
+				},
+			},
+		}
+
+		// 网关处理器只接收带网关标签的对象，不带网关标签的webhook自身pod不依赖webhook
+		var objectSelector *metav1.LabelSelector
+		if h.gateway {
+			objectSelector = &metav1.LabelSelector{
+				MatchLabels: gatewayLabels,
+				MatchExpressions: []metav1.LabelSelectorRequirement{
+					{Key: "app", Operator: metav1.LabelSelectorOpNotIn, Values: []string{parameters.name}},
+				},
+			}
+		}
+
+		return admissionregistrationv1.MutatingWebhook{
+			Name: "mutating-" + h.gvr.Resource + ".ks.com",
+			ClientConfig: admissionregistrationv1.WebhookClientConfig{
+				Service: &admissionregistrationv1.ServiceReference{
+					Name:      parameters.name + "-svc",
+					Namespace: parameters.namespace,
+					Path:      &path,
+				},
+				CABundle: caBundle,
+			},
+			Rules:                   rules,
+			ObjectSelector:          objectSelector,
+			FailurePolicy:           &failurePolicy,
+			SideEffects:             &sideEffects,
+			TimeoutSeconds:          &timeoutSeconds,
+			AdmissionReviewVersions: []string{"v1", "v1beta1"},
+		}
+	}
+
+	config := &admissionregistrationv1.MutatingWebhookConfiguration{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: admissionregistrationv1.SchemeGroupVersion.String(),
+			Kind:       "MutatingWebhookConfiguration",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "mutating-webhook-ks-cfg",
+			Labels: map[string]string{"app": "admission-webhook-ks"},
+		},
+	}
+	for _, h := range enabledHandlers(parameters.features, parameters.handlers) {
+		config.Webhooks = append(config.Webhooks, webhook(h))
+	}
+	return config, nil
+}
+
+// 多个处理器需要相同的权限时只保留一条
+func appendRules(rules []rbacv1.PolicyRule, added ...rbacv1.PolicyRule) []rbacv1.PolicyRule {
+	for _, rule := range added {
+		duplicate := false
+		for _, existing := range rules {
+			if reflect.DeepEqual(existing, rule) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func renderRBAC(parameters manifestsParameters, sdn sdnBackend) []runtime.Object {
+	rules := append([]rbacv1.PolicyRule{}, commonRules...)
+	for _, h := range enabledHandlers(parameters.features, parameters.handlers) {
+		rules = appendRules(rules, h.rules(sdn)...)
+	}
+	namespacedRules := []rbacv1.PolicyRule{
+		{APIGroups: []string{"coordination.k8s.io"}, Resources: []string{"leases"}, Verbs: []string{"get", "create", "update"}},
+	}
+	// 自动分配子网时创建Subnet，集群级别的Subnet在namespace删除后由webhook删除，并在ConfigMap中记录分配结果
+	if len(parameters.supernets) > 0 {
+		subnet := sdn.subnetResource()
+		rules = append(rules, rbacv1.PolicyRule{APIGroups: []string{subnet.Group}, Resources: []string{subnet.Resource}, Verbs: []string{"get", "list", "watch", "create", "delete"}})
+		namespacedRules = append(namespacedRules, rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"get", "create", "update"}})
+	}
+
+	serviceAccount := &corev1.ServiceAccount{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      parameters.name + "-sa",
+			Namespace: parameters.namespace,
+			Labels:    manifestLabels(parameters),
+		},
+	}
+	clusterRole := &rbacv1.ClusterRole{
+		TypeMeta: metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRole"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   parameters.name + "-cr",
+			Labels: manifestLabels(parameters),
+		},
+		Rules: rules,
+	}
+	clusterRoleBinding := &rbacv1.ClusterRoleBinding{
+		TypeMeta: metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRoleBinding"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   parameters.name + "-crb",
+			Labels: manifestLabels(parameters),
+		},
+		Subjects: []rbacv1.Subject{
+			{Kind: rbacv1.ServiceAccountKind, Name: serviceAccount.Name, Namespace: parameters.namespace},
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "ClusterRole",
+			Name:     clusterRole.Name,
+		},
+	}
+
+	// 选主使用的Lease和子网分配记录与webhook部署在同一个namespace
+	role := &rbacv1.Role{
+		TypeMeta: metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "Role"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      parameters.name + "-role",
+			Namespace: parameters.namespace,
+			Labels:    manifestLabels(parameters),
+		},
+		Rules: namespacedRules,
+	}
+	roleBinding := &rbacv1.RoleBinding{
+		TypeMeta: metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "RoleBinding"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      parameters.name + "-rb",
+			Namespace: parameters.namespace,
+			Labels:    manifestLabels(parameters),
+		},
+		Subjects: []rbacv1.Subject{
+			{Kind: rbacv1.ServiceAccountKind, Name: serviceAccount.Name, Namespace: parameters.namespace},
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "Role",
+			Name:     role.Name,
+		},
+	}
+
+	return []runtime.Object{serviceAccount, clusterRole, clusterRoleBinding, role, roleBinding}
+}
+
+// 容器参数与webhook的命令行参数保持一致
+func serverArgs(parameters manifestsParameters) []string {
+	args := []string{
+		"-tlsCertFile=/etc/webhook/certs/cert.crt",
+		"-tlsKeyFile=/etc/webhook/certs/key.key",
+		"-alsologtostderr",
+		"-v=4",
+		"-vpcprefix=" + parameters.vpcprefix,
+		"-cluster=" + parameters.cluster,
+		"-locale=" + parameters.locale,
+		"-features=" + strings.Join(parameters.features, ","),
+		"-leader-elect-name=" + parameters.name,
+		fmt.Sprintf("-timeout=%ds", parameters.timeoutSeconds),
+	}
+	if parameters.clientCA != "" {
+		args = append(args, "-tls-client-ca="+clientCADir+"/"+clientCAKey)
+	}
+	if len(parameters.tls.clientNames) > 0 {
+		args = append(args, "-tls-client-names="+strings.Join(parameters.tls.clientNames, ","))
+	}
+	if parameters.tls.minVersion != "1.2" {
+		args = append(args, "-tls-min-version="+parameters.tls.minVersion)
+	}
+	if len(parameters.tls.cipherSuites) > 0 {
+		args = append(args, "-tls-cipher-suites="+strings.Join(parameters.tls.cipherSuites, ","))
+	}
+	if parameters.sdn != "yunshan" {
+		args = append(args, "-sdn="+parameters.sdn)
+	}
+	if len(parameters.handlers) > 0 {
+		args = append(args, "-handlers="+strings.Join(parameters.handlers, ","))
+	}
+	if len(parameters.failureModes) > 0 {
+		args = append(args, "-failure-mode="+parameters.failureModes.String())
+	}
+	if len(parameters.supernets) > 0 {
+		args = append(args, "-subnet-supernets="+parameters.supernets.String(), fmt.Sprintf("-subnet-prefix-length=%d", parameters.prefixLength))
+	}
+	if parameters.vpcTemplates != "" {
+		args = append(args, "-vpc-templates="+vpcTemplatesDir+"/"+vpcTemplatesKey)
+	}
+	if len(parameters.workspaces) > 0 {
+		args = append(args, "-ws="+strings.Join(parameters.workspaces, ","))
+	}
+	if parameters.unregistered != string(failureModeDeny) {
+		args = append(args, "-unregistered-kinds="+parameters.unregistered)
+	}
+	if parameters.maxInflight != 64 {
+		args = append(args, fmt.Sprintf("-max-inflight=%d", parameters.maxInflight))
+	}
+	if parameters.qps > 0 {
+		args = append(args, "-qps="+strconv.FormatFloat(parameters.qps, 'g', -1, 64), fmt.Sprintf("-burst=%d", parameters.burst))
+	}
+	if len(parameters.vpcOverride.adminGroups) > 0 {
+		args = append(args, "-vpc-override-groups="+strings.Join(parameters.vpcOverride.adminGroups, ","))
+	}
+	if len(parameters.vpcOverride.vpcs) > 0 {
+		args = append(args, "-vpc-override-vpcs="+strings.Join(parameters.vpcOverride.vpcs, ","))
+	}
+	if parameters.auditLog != "" {
+		args = append(args, "-audit-log="+parameters.auditLog)
+	}
+	if parameters.metricsPort > 0 {
+		args = append(args, fmt.Sprintf("-metrics-port=%d", parameters.metricsPort))
+	}
+	if parameters.reportEndpoint {
+		args = append(args, "-report-endpoint")
+	}
+	return args
+}
+
+// vpc模板和客户端CA的ConfigMap的挂载位置
+const (
+	vpcTemplatesDir = "/etc/webhook/vpc-templates"
+	vpcTemplatesKey = "templates.yaml"
+	clientCADir     = "/etc/webhook/client-ca"
+	clientCAKey     = "ca.crt"
+)
+
+func renderDeployment(parameters manifestsParameters) *appsv1.Deployment {
+	replicas := int32(parameters.replicas)
+	labels := manifestLabels(parameters)
+
+	volumeMounts := []corev1.VolumeMount{
+		{Name: "webhook-certs", MountPath: "/etc/webhook/certs", ReadOnly: true},
+	}
+	volumes := []corev1.Volume{
+		{
+			Name: "webhook-certs",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{SecretName: "ks-webhook-certs"},
+			},
+		},
+	}
+	if parameters.vpcTemplates != "" {
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{Name: "vpc-templates", MountPath: vpcTemplatesDir, ReadOnly: true})
+		volumes = append(volumes, corev1.Volume{
+			Name: "vpc-templates",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: parameters.vpcTemplates},
+				},
+			},
+		})
+	}
+	if parameters.clientCA != "" {
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{Name: "client-ca", MountPath: clientCADir, ReadOnly: true})
+		volumes = append(volumes, corev1.Volume{
+			Name: "client-ca",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: parameters.clientCA},
+				},
+			},
+		})
+	}
+	if parameters.auditLog != "" {
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{Name: "audit-log", MountPath: path.Dir(parameters.auditLog)})
+		volumes = append(volumes, corev1.Volume{
+			Name:         "audit-log",
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		})
+	}
+	var ports []corev1.ContainerPort
+	if parameters.metricsPort > 0 {
+		ports = append(ports, corev1.ContainerPort{Name: "metrics", ContainerPort: int32(parameters.metricsPort)})
+	}
+
+	return &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{APIVersion: appsv1.SchemeGroupVersion.String(), Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      parameters.name,
+			Namespace: parameters.namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: parameters.name + "-sa",
+					Containers: []corev1.Container{
+						{
+							Name:            parameters.name,
+							Image:           parameters.image,
+							ImagePullPolicy: corev1.PullIfNotPresent,
+							Args:            serverArgs(parameters),
+							Ports:           ports,
+							Env: []corev1.EnvVar{
+								{
+									Name: "POD_NAMESPACE",
+									ValueFrom: &corev1.EnvVarSource{
+										FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"},
+									},
+								},
+							},
+							VolumeMounts: volumeMounts,
+						},
+					},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+}
+
+func renderService(parameters manifestsParameters) *corev1.Service {
+	return &corev1.Service{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      parameters.name + "-svc",
+			Namespace: parameters.namespace,
+			Labels:    manifestLabels(parameters),
+		},
+		Spec: corev1.ServiceSpec{
+			Ports:    []corev1.ServicePort{{Port: 443, TargetPort: intstr.FromInt(443)}},
+			Selector: manifestLabels(parameters),
+		},
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const generatedHeader = "# Generated by: ks-webhook-controller manifests"
+
+// deploy目录下生成的清单必须与当前代码渲染的结果一致
+func TestDeployManifestsUpToDate(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("deploy", "*.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checked := 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, []byte(generatedHeader)) {
+			continue
+		}
+		checked++
+
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			scanner := bufio.NewScanner(bytes.NewReader(data))
+			scanner.Scan()
+			args := strings.Fields(strings.TrimPrefix(scanner.Text(), generatedHeader))
+
+			parameters, err := parseManifestsFlags(args)
+			if err != nil {
+				t.Fatalf("parse %v: %v", args, err)
+			}
+			objects, err := renderManifests(parameters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var rendered bytes.Buffer
+			if err := writeManifests(&rendered, objects); err != nil {
+				t.Fatal(err)
+			}
+
+			// 跳过两行注释
+			body := data[bytes.IndexByte(data, '\n')+1:]
+			body = body[bytes.IndexByte(body, '\n')+1:]
+			if !bytes.Equal(body, rendered.Bytes()) {
+				t.Errorf("%s is out of date, regenerate it with: ks-webhook-controller manifests %s", file, strings.Join(args, " "))
+			}
+		})
+	}
+
+	if checked == 0 {
+		t.Fatal("no generated manifests found in deploy/")
+	}
+}
+
+func TestManifestsFollowFeatures(t *testing.T) {
+	parameters, err := parseManifestsFlags([]string{"-features", "vpcLabel"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webhook, err := renderWebhookConfiguration(parameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(webhook.Webhooks) != 1 || len(webhook.Webhooks[0].Rules) != 1 {
+		t.Fatalf("expected a single namespaces rule, got %+v", webhook.Webhooks)
+	}
+	if got := webhook.Webhooks[0].Rules[0].Resources; len(got) != 1 || got[0] != "namespaces" {
+		t.Errorf("unexpected resources %v", got)
+	}
+
+	if _, err := parseManifestsFlags([]string{"-features", "vpcLabel,bogus"}); err != nil {
+		t.Fatal(err)
+	}
+	parameters.features = sliceFlag{"bogus"}
+	if _, err := renderManifests(parameters); err == nil {
+		t.Error("expected an error for an unknown feature")
+	}
+}
+
+func TestManifestsFollowSDN(t *testing.T) {
+	parameters, err := parseManifestsFlags([]string{"-sdn", "kube-ovn", "-subnet-supernets", "*=10.16.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups := make(map[string]bool)
+	for _, rule := range renderRBAC(parameters, kubeOVNBackend{})[1].(*rbacv1.ClusterRole).Rules {
+		for _, group := range rule.APIGroups {
+			groups[group] = true
+		}
+	}
+	if !groups["kubeovn.io"] || groups["nci.yunshan.net"] {
+		t.Errorf("unexpected api groups %v", groups)
+	}
+	if args := serverArgs(parameters); !sliceFlag(args).has("-sdn=kube-ovn") {
+		t.Errorf("missing -sdn in %v", args)
+	}
+
+	parameters.sdn = "bogus"
+	if _, err := renderManifests(parameters); err == nil {
+		t.Error("expected an error for an unknown sdn")
+	}
+
+	// Calico不支持自动分配子网
+	parameters.sdn = "calico"
+	if _, err := renderManifests(parameters); err == nil {
+		t.Error("expected an error for subnet provisioning with calico")
+	}
+}
+
+// 网关处理器只接收带网关标签的对象，namespace的webhook不受影响
+func TestManifestsSelectGateways(t *testing.T) {
+	parameters, err := parseManifestsFlags(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhook, err := renderWebhookConfiguration(parameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, w := range webhook.Webhooks {
+		resource := w.Rules[0].Resources[0]
+		h, _ := handlerForResource(resource)
+		if !h.gateway {
+			if w.ObjectSelector != nil {
+				t.Errorf("%s: unexpected objectSelector %v", resource, w.ObjectSelector)
+			}
+			continue
+		}
+		selector, err := metav1.LabelSelectorAsSelector(w.ObjectSelector)
+		if err != nil {
+			t.Fatalf("%s: %v", resource, err)
+		}
+		if !selector.Matches(labels.Set(gatewayLabels)) {
+			t.Errorf("%s: objectSelector %v does not match gateways", resource, selector)
+		}
+		if selector.Matches(labels.Set{"app": parameters.name}) {
+			t.Errorf("%s: objectSelector %v matches the webhook's own pods", resource, selector)
+		}
+	}
+}
+
+// 容器参数覆盖webhook的限流、审计和metrics选项，默认值不输出
+func TestManifestsServerArgs(t *testing.T) {
+	parameters, err := parseManifestsFlags(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, arg := range serverArgs(parameters) {
+		if strings.HasPrefix(arg, "-max-inflight") || strings.HasPrefix(arg, "-qps") || strings.HasPrefix(arg, "-unregistered-kinds") || strings.HasPrefix(arg, "-metrics-port") {
+			t.Errorf("unexpected default %s", arg)
+		}
+	}
+
+	parameters, err = parseManifestsFlags([]string{
+		"-unregistered-kinds", "allow", "-max-inflight", "0", "-qps", "12.5", "-burst", "20",
+		"-vpc-override-groups", "platform-admins", "-vpc-override-vpcs", "shared-a,shared-b",
+		"-audit-log", "/var/log/ks-webhook/audit.log", "-metrics-port", "8080", "-report-endpoint",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := sliceFlag(serverArgs(parameters))
+	for _, want := range []string{
+		"-unregistered-kinds=allow", "-max-inflight=0", "-qps=12.5", "-burst=20",
+		"-vpc-override-groups=platform-admins", "-vpc-override-vpcs=shared-a,shared-b",
+		"-audit-log=/var/log/ks-webhook/audit.log", "-metrics-port=8080", "-report-endpoint",
+	} {
+		if !args.has(want) {
+			t.Errorf("missing %s in %v", want, args)
+		}
+	}
+
+	container := renderDeployment(parameters).Spec.Template.Spec.Containers[0]
+	if len(container.Ports) != 1 || container.Ports[0].ContainerPort != 8080 {
+		t.Errorf("unexpected ports %+v", container.Ports)
+	}
+	mounted := false
+	for _, mount := range container.VolumeMounts {
+		mounted = mounted || mount.MountPath == "/var/log/ks-webhook"
+	}
+	if !mounted {
+		t.Errorf("audit log directory not mounted in %+v", container.VolumeMounts)
+	}
+
+	for _, invalid := range []manifestsParameters{
+		{unregistered: "bogus"},
+		{qps: 10},
+		{auditLog: "audit.log"},
+		{reportEndpoint: true},
+	} {
+		invalid.sdn, invalid.features, invalid.tls.minVersion = "yunshan", allFeatures, "1.2"
+		if invalid.unregistered == "" {
+			invalid.unregistered = string(failureModeDeny)
+		}
+		if _, err := renderManifests(invalid); err == nil {
+			t.Errorf("expected an error for %+v", invalid)
+		}
+	}
+}
+
+// 客户端CA通过ConfigMap挂载，TLS参数原样传给webhook
+func TestManifestsTLS(t *testing.T) {
+	parameters, err := parseManifestsFlags([]string{
+		"-tls-client-ca-configmap", "apiserver-client-ca", "-tls-client-names", "kube-apiserver",
+		"-tls-min-version", "1.2", "-tls-cipher-suites", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := sliceFlag(serverArgs(parameters))
+	for _, want := range []string{
+		"-tls-client-ca=" + clientCADir + "/" + clientCAKey, "-tls-client-names=kube-apiserver",
+		"-tls-cipher-suites=TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	} {
+		if !args.has(want) {
+			t.Errorf("missing %s in %v", want, args)
+		}
+	}
+	if args.has("-tls-min-version=1.2") {
+		t.Errorf("unexpected default in %v", args)
+	}
+
+	deployment := renderDeployment(parameters)
+	mounted := false
+	for _, mount := range deployment.Spec.Template.Spec.Containers[0].VolumeMounts {
+		mounted = mounted || (mount.Name == "client-ca" && mount.MountPath == clientCADir)
+	}
+	found := false
+	for _, volume := range deployment.Spec.Template.Spec.Volumes {
+		found = found || (volume.ConfigMap != nil && volume.ConfigMap.Name == "apiserver-client-ca")
+	}
+	if !mounted || !found {
+		t.Errorf("client CA not mounted: %+v", deployment.Spec.Template.Spec)
+	}
+
+	for _, invalid := range [][]string{
+		{"-tls-client-names", "kube-apiserver"},
+		{"-tls-min-version", "1.4"},
+		{"-tls-min-version", "1.3", "-tls-cipher-suites", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+		{"-tls-cipher-suites", "TLS_RSA_WITH_RC4_128_SHA"},
+	} {
+		parameters, err := parseManifestsFlags(invalid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := renderManifests(parameters); err == nil {
+			t.Errorf("expected an error for %v", invalid)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 面向用户的提示信息统一从消息目录中按语言取出
+type locale string
+
+const (
+	localeZh locale = "zh"
+	localeEn locale = "en"
+)
+
+// 未指定语言或语言不支持时使用的默认语言，可以通过-locale选项修改
+var defaultLocale = localeZh
+
+type messageID string
+
+const (
+	msgNotInWorkspace        messageID = "NotInWorkspace"
+	msgWorkspaceNotFound     messageID = "WorkspaceNotFound"
+	msgWorkspaceLookupFailed messageID = "WorkspaceLookupFailed"
+	msgSubnetNotFound        messageID = "SubnetNotFound"
+	msgSubnetLookupFailed    messageID = "SubnetLookupFailed"
+	msgSubnetConvertFailed   messageID = "SubnetConvertFailed"
+	msgVpcOperationFailed    messageID = "VpcOperationFailed"
+	msgNamespaceLookupFailed messageID = "NamespaceLookupFailed"
+	msgPolicyLookupFailed    messageID = "PolicyLookupFailed"
+	msgPatchMarshalFailed    messageID = "PatchMarshalFailed"
+	msgObjectDecodeFailed    messageID = "ObjectDecodeFailed"
+	msgUnsupportedKind       messageID = "UnsupportedKind"
+	msgUnexpectedError       messageID = "UnexpectedError"
+	msgAllowedOnFailure      messageID = "AllowedOnFailure"
+	msgVpcTemplateFailed     messageID = "VpcTemplateFailed"
+	msgVpcFieldMissing       messageID = "VpcFieldMissing"
+	msgVpcJoinFailed         messageID = "VpcJoinFailed"
+	msgGatewayLookupFailed   messageID = "GatewayLookupFailed"
+	msgOverloaded            messageID = "Overloaded"
+	msgVpcOverrideForbidden  messageID = "VpcOverrideForbidden"
+	msgVpcOverrideNotAllowed messageID = "VpcOverrideNotAllowed"
+	msgVpcBindingForbidden   messageID = "VpcBindingForbidden"
+	msgFixedIPReserveFailed  messageID = "FixedIPReserveFailed"
+	msgFixedIPsExhausted     messageID = "FixedIPsExhausted"
+)
+
+var messageCatalog = map[locale]map[messageID]string{
+	localeZh: {
+		msgNotInWorkspace:        "namespace: \"%v\" 不属于任何业务空间",
+		msgWorkspaceNotFound:     "业务空间: \"%v\" 不存在",
+		msgWorkspaceLookupFailed: "查询业务空间: \"%v\" 失败",
+		msgSubnetNotFound:        "namespace: \"%v\" 没有关联到子网，请排查sdn网络",
+		msgSubnetLookupFailed:    "查询namespace: \"%v\" 的子网失败",
+		msgSubnetConvertFailed:   "解析namespace: \"%v\" 的子网失败",
+		msgVpcOperationFailed:    "Vpc %v %v 失败",
+		msgNamespaceLookupFailed: "查询namespace: \"%v\" 失败",
+		msgPolicyLookupFailed:    "查询WebhookPolicy失败",
+		msgPatchMarshalFailed:    "生成patch失败",
+		msgObjectDecodeFailed:    "无法解析请求对象: %v",
+		msgUnsupportedKind:       "不支持的资源类型: %v",
+		msgUnexpectedError:       "未知错误",
+		msgAllowedOnFailure:      "依赖服务不可用，已按failure-mode放行: %v",
+		msgVpcTemplateFailed:     "生成Vpc %v 的模板失败",
+		msgVpcFieldMissing:       "Vpc %v 缺少%v，请在vpc模板中为业务空间设置",
+		msgVpcJoinFailed:         "将namespace: \"%v\" 登记到vpc: \"%v\" 失败",
+		msgGatewayLookupFailed:   "查询namespace: \"%v\" 的网关失败",
+		msgOverloaded:            "webhook繁忙(%v)，请稍后重试",
+		msgVpcOverrideForbidden:  "用户: \"%v\" 不在管理员组中，不能为namespace: \"%v\" 指定vpc",
+		msgVpcOverrideNotAllowed: "Vpc \"%v\" 不在允许指定的列表中，namespace: \"%v\" 不能使用",
+		msgVpcBindingForbidden:   "用户: \"%v\" 不在管理员组中，不能将namespace: \"%v\" 绑定到vpc: \"%v\"",
+		msgFixedIPReserveFailed:  "为网关: \"%v\" 预留固定ip失败",
+		msgFixedIPsExhausted:     "IPPool: \"%v\" 的前%v个地址都已经被占用，不能为网关: \"%v\" 预留固定ip",
+	},
+	localeEn: {
+		msgNotInWorkspace:        "Invalid namespace: \"%v\" not in workspace",
+		msgWorkspaceNotFound:     "Workspace \"%v\" does not exist",
+		msgWorkspaceLookupFailed: "Failed to look up workspace \"%v\"",
+		msgSubnetNotFound:        "Namespace \"%v\" is not bound to any subnet, please check the SDN network",
+		msgSubnetLookupFailed:    "Failed to look up subnets of namespace \"%v\"",
+		msgSubnetConvertFailed:   "Failed to decode subnets of namespace \"%v\"",
+		msgVpcOperationFailed:    "Vpc %v %v failed",
+		msgNamespaceLookupFailed: "Failed to look up namespace \"%v\"",
+		msgPolicyLookupFailed:    "Failed to look up WebhookPolicies",
+		msgPatchMarshalFailed:    "Failed to marshal patch",
+		msgObjectDecodeFailed:    "Could not decode request object: %v",
+		msgUnsupportedKind:       "Not support for this Kind of resource %v",
+		msgUnexpectedError:       "Unexpected error",
+		msgAllowedOnFailure:      "Dependency unavailable, admitted by failure mode: %v",
+		msgVpcTemplateFailed:     "Failed to render the template of vpc %v",
+		msgVpcFieldMissing:       "Vpc %v has no %v, set it for the workspace in a vpc template",
+		msgVpcJoinFailed:         "Failed to add namespace \"%v\" to vpc \"%v\"",
+		msgGatewayLookupFailed:   "Failed to look up gateways of namespace \"%v\"",
+		msgOverloaded:            "Webhook is overloaded (%v), please retry later",
+		msgVpcOverrideForbidden:  "User \"%v\" is not in an admin group and cannot set the vpc of namespace \"%v\"",
+		msgVpcOverrideNotAllowed: "Vpc \"%v\" is not allowed as an override, namespace \"%v\" cannot use it",
+		msgVpcBindingForbidden:   "User \"%v\" is not in an admin group and cannot bind namespace \"%v\" to vpc \"%v\"",
+		msgFixedIPReserveFailed:  "Failed to reserve a fixed ip for gateway \"%v\"",
+		msgFixedIPsExhausted:     "IPPool \"%v\" has no free address among its first %v for gateway \"%v\"",
+	},
+}
+
+// 按语言格式化提示信息，缺少翻译时回退到默认语言
+func localize(loc locale, id messageID, args ...interface{}) string {
+	format, ok := messageCatalog[loc][id]
+	if !ok {
+		format, ok = messageCatalog[defaultLocale][id]
+	}
+	if !ok {
+		format = string(id)
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// 解析语言标签，例如zh-CN、en_US，不支持的语言返回false
+func parseLocale(tag string) (locale, bool) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if i := strings.IndexAny(tag, "-_"); i >= 0 {
+		tag = tag[:i]
+	}
+	loc := locale(tag)
+	if _, ok := messageCatalog[loc]; !ok {
+		return "", false
+	}
+	return loc, true
+}
+
+// 根据Accept-Language选择语言，按q值从高到低取第一个支持的语言，q值相同时按出现顺序
+func negotiateLocale(acceptLanguage string, fallback locale) locale {
+	type languageRange struct {
+		tag string
+		q   float64
+	}
+	var ranges []languageRange
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		params := strings.Split(part, ";")
+		r := languageRange{tag: params[0], q: 1}
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "q") {
+				q, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					q = 0
+				}
+				r.q = q
+			}
+		}
+		// q=0表示不接受该语言
+		if r.q > 0 {
+			ranges = append(ranges, r)
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+	for _, r := range ranges {
+		if loc, ok := parseLocale(r.tag); ok {
+			return loc
+		}
+	}
+	return fallback
+}
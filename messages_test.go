@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNegotiateLocale(t *testing.T) {
+	for header, want := range map[string]locale{
+		"":                           localeZh,
+		"en-US,en;q=0.9":             localeEn,
+		"fr, en;q=0.5":               localeEn,
+		"en;q=0.1, zh;q=0.9":         localeZh,
+		"zh-CN;q=0.8, en-US;q=0.8":   localeZh,
+		"en;q=0, fr":                 localeZh,
+		"en;q=bad, zh;q=0.2":         localeZh,
+		"de;q=1.0, en-GB;q=0.7, *":   localeEn,
+		"en_US; Q=0.3, zh_CN; q=0.2": localeEn,
+	} {
+		if got := negotiateLocale(header, localeZh); got != want {
+			t.Errorf("negotiateLocale(%q) = %s, want %s", header, got, want)
+		}
+	}
+}
+
+// 每条提示信息都有中英文翻译，并且参数个数一致
+func TestMessageCatalogComplete(t *testing.T) {
+	for id, zh := range messageCatalog[localeZh] {
+		en, ok := messageCatalog[localeEn][id]
+		if !ok {
+			t.Errorf("%s has no English translation", id)
+			continue
+		}
+		if strings.Count(zh, "%v") != strings.Count(en, "%v") {
+			t.Errorf("%s: %q and %q take different arguments", id, zh, en)
+		}
+	}
+	for id := range messageCatalog[localeEn] {
+		if _, ok := messageCatalog[localeZh][id]; !ok {
+			t.Errorf("%s has no Chinese translation", id)
+		}
+	}
+}
+
+func TestLocalize(t *testing.T) {
+	if got := localize(localeEn, msgWorkspaceNotFound, "leo-test"); got != `Workspace "leo-test" does not exist` {
+		t.Errorf("unexpected English message %q", got)
+	}
+	if got := localize(localeZh, msgWorkspaceNotFound, "leo-test"); got != `业务空间: "leo-test" 不存在` {
+		t.Errorf("unexpected Chinese message %q", got)
+	}
+	// 没有翻译的消息输出消息ID
+	if got := localize(localeEn, messageID("Missing")); got != "Missing" {
+		t.Errorf("unexpected fallback %q", got)
+	}
+	if got := denied(localeEn, policyViolation(msgNotInWorkspace, "leo")).Result.Message; got != `Invalid namespace: "leo" not in workspace` {
+		t.Errorf("denial is not localized: %q", got)
+	}
+}
+
+func TestParseLocale(t *testing.T) {
+	for tag, want := range map[string]locale{"zh-CN": localeZh, "en_US": localeEn, " EN ": localeEn} {
+		if got, ok := parseLocale(tag); !ok || got != want {
+			t.Errorf("parseLocale(%q) = %s, %v", tag, got, ok)
+		}
+	}
+	if _, ok := parseLocale("fr"); ok {
+		t.Error("fr is not supported")
+	}
+}
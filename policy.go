@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// WebhookPolicy是集群级别的资源，按业务空间、namespace和对象标签开启或关闭webhook的功能
+var webhookPolicyGVR = schema.GroupVersionResource{
+	Group:    "admission-webhook-ks.cmft",
+	Version:  "v1alpha1",
+	Resource: "webhookpolicies",
+}
+
+// webhook的功能开关
+type feature string
+
+const (
+	// 为namespace打上vpc标签
+	featureVpcLabel feature = "vpcLabel"
+	// 为网关应用注入固定ip地址
+	featureFixedIPs feature = "fixedIPs"
+	// 随业务空间创建和删除vpc
+	featureVpcLifecycle feature = "vpcLifecycle"
+)
+
+type WebhookPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []WebhookPolicy `json:"items"`
+}
+
+type WebhookPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              WebhookPolicySpec `json:"spec"`
+}
+
+type WebhookPolicySpec struct {
+	// 多个策略对同一功能都有设置时，优先级高的生效
+	Priority int32 `json:"priority,omitempty"`
+	// 业务空间名称，为空时匹配所有业务空间
+	Workspaces []string `json:"workspaces,omitempty"`
+	// 按namespace标签匹配，为空时匹配所有namespace；对业务空间的请求没有namespace，设置后不会匹配
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// 按对象自身的标签匹配，为空时匹配所有对象
+	ObjectSelector *metav1.LabelSelector `json:"objectSelector,omitempty"`
+	Features       PolicyFeatures        `json:"features"`
+}
+
+// 未设置的功能不受该策略影响
+type PolicyFeatures struct {
+	VpcLabel     *bool `json:"vpcLabel,omitempty"`
+	FixedIPs     *bool `json:"fixedIPs,omitempty"`
+	VpcLifecycle *bool `json:"vpcLifecycle,omitempty"`
+}
+
+func (f PolicyFeatures) get(name feature) *bool {
+	switch name {
+	case featureVpcLabel:
+		return f.VpcLabel
+	case featureFixedIPs:
+		return f.FixedIPs
+	case featureVpcLifecycle:
+		return f.VpcLifecycle
+	}
+	return nil
+}
+
+// 策略匹配时使用的对象信息
+type policySubject struct {
+	workspace       string
+	namespaceLabels map[string]string // 集群级别的对象为nil
+	objectLabels    map[string]string
+}
+
+// WebhookPolicy和namespace的缓存，每个副本在开始处理请求前启动，避免每个请求都查询apiserver
+// 缓存未同步时(例如CRD未安装)以及新建的namespace还没有进入缓存时，仍然直接查询
+// 集群级别的子网(Kube-OVN)也在这里缓存，并按绑定的namespace建立索引
+type policyCache struct {
+	policies   informers.GenericInformer
+	namespaces informers.GenericInformer
+	subnets    informers.GenericInformer // sdn不是subnetIndexer时为nil
+}
+
+// 缓存的全量同步间隔，watch断开时informer会重新list，这里只是兜底
+const policyCacheResync = 10 * time.Minute
+
+// 子网缓存中按namespace查找子网的索引
+const subnetNamespaceIndex = "subnetNamespaces"
+
+func startPolicyCache(ctx context.Context, client dynamic.Interface, backend sdnBackend) *policyCache {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, policyCacheResync)
+	c := &policyCache{
+		policies:   factory.ForResource(webhookPolicyGVR),
+		namespaces: factory.ForResource(namespaceGVR),
+	}
+	if indexer, ok := backend.(subnetIndexer); ok {
+		c.subnets = factory.ForResource(backend.subnetResource())
+		err := c.subnets.Informer().AddIndexers(cache.Indexers{subnetNamespaceIndex: func(obj interface{}) ([]string, error) {
+			subnet, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				return nil, nil
+			}
+			return indexer.subnetNamespaces(subnet)
+		}})
+		if err != nil {
+			glog.Errorf("Failed to index subnets by namespace: %v", err)
+			c.subnets = nil
+		}
+	}
+	factory.Start(ctx.Done())
+	return c
+}
+
+// namespace关联的子网，缓存同步后从缓存中按索引查找
+func (c *Client) namespaceSubnets(ctx context.Context, namespace string) ([]sdnSubnet, error) {
+	backend := c.backend()
+	if indexer, ok := backend.(subnetIndexer); ok && c.cache != nil && c.cache.subnets != nil && c.cache.subnets.Informer().HasSynced() {
+		objs, err := c.cache.subnets.Informer().GetIndexer().ByIndex(subnetNamespaceIndex, namespace)
+		if err != nil {
+			return nil, internalError(err, msgSubnetConvertFailed, namespace)
+		}
+		subnets := make([]sdnSubnet, 0, len(objs))
+		for _, obj := range objs {
+			subnets = append(subnets, indexer.subnetOf(obj.(*unstructured.Unstructured)))
+		}
+		// 与直接查询一样按名称排序，getSubnet使用最后一个
+		sort.Slice(subnets, func(i, j int) bool { return subnets[i].Name < subnets[j].Name })
+		return subnets, nil
+	}
+	return backend.namespaceSubnets(ctx, c.dynamicClient, namespace)
+}
+
+// 查询所有的WebhookPolicy，CRD未安装时按没有策略处理
+func (c *Client) listPolicies(ctx context.Context) ([]WebhookPolicy, error) {
+	if c.cache != nil && c.cache.policies.Informer().HasSynced() {
+		objs, err := c.cache.policies.Lister().List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		policies := make([]WebhookPolicy, 0, len(objs))
+		for _, obj := range objs {
+			var policy WebhookPolicy
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.(*unstructured.Unstructured).UnstructuredContent(), &policy); err != nil {
+				return nil, err
+			}
+			policies = append(policies, policy)
+		}
+		return policies, nil
+	}
+
+	unStructData, err := c.dynamicClient.Resource(webhookPolicyGVR).List(ctx, metav1.ListOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var obj WebhookPolicyList
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(unStructData.UnstructuredContent(), &obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return obj.Items, nil
+}
+
+// 判断功能是否开启，没有策略设置该功能时默认开启
+func (c *Client) featureEnabled(ctx context.Context, name feature, subject policySubject) (bool, error) {
+	policies, err := c.listPolicies(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return resolveFeature(policies, name, subject), nil
+}
+
+func resolveFeature(policies []WebhookPolicy, name feature, subject policySubject) bool {
+	// 优先级从高到低，相同优先级按名称排序
+	sort.SliceStable(policies, func(i, j int) bool {
+		if policies[i].Spec.Priority != policies[j].Spec.Priority {
+			return policies[i].Spec.Priority > policies[j].Spec.Priority
+		}
+		return policies[i].Name < policies[j].Name
+	})
+
+	for _, policy := range policies {
+		value := policy.Spec.Features.get(name)
+		if value == nil || !policyMatches(policy, subject) {
+			continue
+		}
+		glog.Infof("WebhookPolicy %s sets %s=%v", policy.Name, name, *value)
+		return *value
+	}
+
+	return true
+}
+
+func policyMatches(policy WebhookPolicy, subject policySubject) bool {
+	spec := policy.Spec
+
+	if len(spec.Workspaces) > 0 {
+		matched := false
+		for _, ws := range spec.Workspaces {
+			if ws == subject.workspace {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if spec.NamespaceSelector != nil {
+		if subject.namespaceLabels == nil {
+			return false
+		}
+		if !selectorMatches(policy.Name, spec.NamespaceSelector, subject.namespaceLabels) {
+			return false
+		}
+	}
+
+	if spec.ObjectSelector != nil && !selectorMatches(policy.Name, spec.ObjectSelector, subject.objectLabels) {
+		return false
+	}
+
+	return true
+}
+
+// 非法的selector不匹配任何对象
+func selectorMatches(policyName string, selector *metav1.LabelSelector, set map[string]string) bool {
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		glog.Errorf("Invalid selector in WebhookPolicy %s: %v", policyName, err)
+		return false
+	}
+	return s.Matches(labels.Set(set))
+}
+
+// 查询namespace的标签，用于匹配策略的namespaceSelector
+func (c *Client) namespaceLabels(ctx context.Context, namespace string) (map[string]string, error) {
+	if c.cache != nil && c.cache.namespaces.Informer().HasSynced() {
+		if obj, err := c.cache.namespaces.Lister().Get(namespace); err == nil {
+			nsLabels := obj.(*unstructured.Unstructured).GetLabels()
+			if nsLabels == nil {
+				nsLabels = map[string]string{}
+			}
+			return nsLabels, nil
+		}
+	}
+
+	unStructData, err := c.dynamicClient.Resource(namespaceGVR).Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	nsLabels := unStructData.GetLabels()
+	if nsLabels == nil {
+		nsLabels = map[string]string{}
+	}
+	return nsLabels, nil
+}
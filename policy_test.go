@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestResolveFeature(t *testing.T) {
+	policy := func(name string, priority int32, spec WebhookPolicySpec) WebhookPolicy {
+		spec.Priority = priority
+		return WebhookPolicy{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: spec}
+	}
+
+	optIn := &metav1.LabelSelector{MatchLabels: map[string]string{"fixed-ip": "true"}}
+	policies := []WebhookPolicy{
+		policy("off", 0, WebhookPolicySpec{Features: PolicyFeatures{FixedIPs: boolPtr(false)}}),
+		policy("opt-in", 10, WebhookPolicySpec{NamespaceSelector: optIn, Features: PolicyFeatures{FixedIPs: boolPtr(true)}}),
+		policy("ws", 0, WebhookPolicySpec{Workspaces: []string{"ws1"}, Features: PolicyFeatures{VpcLabel: boolPtr(false)}}),
+		policy("a-tie", 5, WebhookPolicySpec{ObjectSelector: optIn, Features: PolicyFeatures{VpcLifecycle: boolPtr(false)}}),
+		policy("b-tie", 5, WebhookPolicySpec{ObjectSelector: optIn, Features: PolicyFeatures{VpcLifecycle: boolPtr(true)}}),
+	}
+
+	cases := []struct {
+		name    string
+		feature feature
+		subject policySubject
+		want    bool
+	}{
+		{name: "lower priority default", feature: featureFixedIPs, subject: policySubject{namespaceLabels: map[string]string{}}, want: false},
+		{name: "higher priority opt in", feature: featureFixedIPs, subject: policySubject{namespaceLabels: map[string]string{"fixed-ip": "true"}}, want: true},
+		{name: "namespace selector skips cluster scoped", feature: featureFixedIPs, subject: policySubject{objectLabels: map[string]string{"fixed-ip": "true"}}, want: false},
+		{name: "workspace match", feature: featureVpcLabel, subject: policySubject{workspace: "ws1"}, want: false},
+		{name: "workspace mismatch", feature: featureVpcLabel, subject: policySubject{workspace: "ws2"}, want: true},
+		{name: "tie broken by name", feature: featureVpcLifecycle, subject: policySubject{objectLabels: map[string]string{"fixed-ip": "true"}}, want: false},
+		{name: "no policy sets feature", feature: featureVpcLifecycle, subject: policySubject{}, want: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := resolveFeature(policies, c.feature, c.subject); got != c.want {
+				t.Errorf("resolveFeature(%s) = %v, want %v", c.feature, got, c.want)
+			}
+		})
+	}
+}
+
+// 缓存同步后，策略和namespace标签不再查询apiserver
+func TestPolicyCache(t *testing.T) {
+	objects, err := decodeManifests([]byte(`
+apiVersion: admission-webhook-ks.cmft/v1alpha1
+kind: WebhookPolicy
+metadata:
+  name: fixed-ip-opt-out
+spec:
+  features:
+    fixedIPs: false
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: team-a
+  labels:
+    fixed-ip: "false"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dynamicClient, err := newFakeClient(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &Client{dynamicClient: dynamicClient, cache: startPolicyCache(ctx, dynamicClient, yunshanBackend{})}
+	if !cache.WaitForCacheSync(ctx.Done(), c.cache.policies.Informer().HasSynced, c.cache.namespaces.Informer().HasSynced) {
+		t.Fatal("cache is not synced")
+	}
+	actions := len(dynamicClient.Actions())
+
+	policies, err := c.listPolicies(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 1 || policies[0].Name != "fixed-ip-opt-out" || policies[0].Spec.Features.FixedIPs == nil || *policies[0].Spec.Features.FixedIPs {
+		t.Errorf("unexpected policies %+v", policies)
+	}
+	nsLabels, err := c.namespaceLabels(ctx, "team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nsLabels["fixed-ip"] != "false" {
+		t.Errorf("unexpected labels %v", nsLabels)
+	}
+	if got := dynamicClient.Actions()[actions:]; len(got) != 0 {
+		t.Errorf("unexpected requests to the apiserver: %v", got)
+	}
+}
+
+// Kube-OVN的子网按绑定的namespace建立索引，注入固定ip时不再list所有子网
+func TestSubnetCache(t *testing.T) {
+	objects, err := decodeManifests([]byte(`
+apiVersion: kubeovn.io/v1
+kind: Subnet
+metadata:
+  name: team-a
+spec:
+  cidrBlock: 10.16.0.0/24,fd00:10:16::/120
+  gateway: 10.16.0.1,fd00:10:16::1
+  namespaces:
+  - team-a
+  - team-b
+---
+apiVersion: kubeovn.io/v1
+kind: Subnet
+metadata:
+  name: team-c
+spec:
+  cidrBlock: 10.17.0.0/24
+  namespaces:
+  - team-c
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dynamicClient, err := newFakeClient(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &Client{dynamicClient: dynamicClient, sdn: kubeOVNBackend{}, cache: startPolicyCache(ctx, dynamicClient, kubeOVNBackend{})}
+	if !cache.WaitForCacheSync(ctx.Done(), c.cache.subnets.Informer().HasSynced) {
+		t.Fatal("cache is not synced")
+	}
+	actions := len(dynamicClient.Actions())
+
+	for _, ns := range []string{"team-a", "team-b"} {
+		subnets, err := c.namespaceSubnets(ctx, ns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []sdnSubnet{{Name: "team-a", CIDR: "10.16.0.0/24", Gateway: "10.16.0.1"}}; !reflect.DeepEqual(subnets, want) {
+			t.Errorf("subnets of %s: %+v", ns, subnets)
+		}
+	}
+	if subnets, err := c.namespaceSubnets(ctx, "team-d"); err != nil || len(subnets) != 0 {
+		t.Errorf("subnets of team-d: %+v, %v", subnets, err)
+	}
+	if got := dynamicClient.Actions()[actions:]; len(got) != 0 {
+		t.Errorf("unexpected requests to the apiserver: %v", got)
+	}
+
+	// 其他sdn不缓存子网
+	if startPolicyCache(ctx, dynamicClient, yunshanBackend{}).subnets != nil {
+		t.Error("yunshan subnets are cached")
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// 实际状态与webhook规则不一致的类型
+type driftKind string
+
+const (
+	// namespace没有vpc标签
+	driftMissingVpcLabel driftKind = "MissingVpcLabel"
+	// namespace的vpc标签与generateVpcName的结果不一致
+	driftWrongVpcLabel driftKind = "WrongVpcLabel"
+	// namespace所属的业务空间不存在
+	driftMissingWorkspace driftKind = "MissingWorkspace"
+	// 业务空间或namespace对应的vpc不存在
+	driftMissingVpc driftKind = "MissingVpc"
+	// vpc所属的业务空间不存在，或业务空间已经使用其他vpc
+	driftOrphanVpc driftKind = "OrphanVpc"
+)
+
+type driftFinding struct {
+	Kind      driftKind `json:"kind"`
+	Resource  string    `json:"resource"` // Namespace、Workspace或VPC
+	Name      string    `json:"name"`
+	Workspace string    `json:"workspace,omitempty"`
+	Expected  string    `json:"expected,omitempty"`
+	Actual    string    `json:"actual,omitempty"`
+}
+
+type driftReport struct {
+	Findings []driftFinding `json:"findings"`
+}
+
+// 按webhook的规则检查现有的业务空间、namespace和vpc，列出所有不一致
+func buildDriftReport(ctx context.Context, svmate serverMate) (*driftReport, error) {
+	client := svmate.client.dynamicClient
+	backend := svmate.client.backend()
+
+	list := func(gvr schema.GroupVersionResource) ([]unstructured.Unstructured, error) {
+		items, err := client.Resource(gvr).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %v", gvr.Resource, err)
+		}
+		return items.Items, nil
+	}
+	workspaceList, err := list(workspaceGVR)
+	if err != nil {
+		return nil, err
+	}
+	vpcList, err := list(backend.vpcResource())
+	if err != nil {
+		return nil, err
+	}
+	namespaceList, err := list(namespaceGVR)
+	if err != nil {
+		return nil, err
+	}
+	policies, err := svmate.client.listPolicies(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	workspaces := make(map[string]unstructured.Unstructured)
+	for _, ws := range workspaceList {
+		workspaces[ws.GetName()] = ws
+	}
+	vpcs := make(map[string]bool)
+	for _, vpc := range vpcList {
+		vpcs[vpc.GetName()] = true
+	}
+	expectedVpc := func(workspace string) string {
+		if svmate.vpcprefix == "default" {
+			return backend.defaultVpc()
+		}
+		return generateVpcName(workspace, svmate)
+	}
+
+	report := &driftReport{Findings: []driftFinding{}}
+	add := func(f driftFinding) {
+		report.Findings = append(report.Findings, f)
+	}
+
+	for _, ns := range namespaceList {
+		workspace, ok := ns.GetLabels()[admissionWebhookWorkspaceKey]
+		meta := metav1.ObjectMeta{Name: ns.GetName(), Labels: ns.GetLabels(), Annotations: ns.GetAnnotations()}
+		if !ok || !admissionRequired(admissionWebhookAnnotationMutateKey, &meta) {
+			continue
+		}
+		if !resolveFeature(policies, featureVpcLabel, policySubject{workspace: workspace, namespaceLabels: meta.Labels, objectLabels: meta.Labels}) {
+			continue
+		}
+		if _, ok := workspaces[workspace]; !ok {
+			add(driftFinding{Kind: driftMissingWorkspace, Resource: "Namespace", Name: ns.GetName(), Workspace: workspace})
+			continue
+		}
+
+		//指定了vpc的namespace以指定的vpc为准
+		expected, ok := vpcOverride(&meta)
+		if !ok {
+			expected = expectedVpc(workspace)
+		}
+		actual, labelled := backend.namespaceVpc(&ns)
+		switch {
+		case !labelled:
+			add(driftFinding{Kind: driftMissingVpcLabel, Resource: "Namespace", Name: ns.GetName(), Workspace: workspace, Expected: expected})
+		case actual != expected:
+			add(driftFinding{Kind: driftWrongVpcLabel, Resource: "Namespace", Name: ns.GetName(), Workspace: workspace, Expected: expected, Actual: actual})
+		}
+		if labelled && actual != backend.defaultVpc() && !vpcs[actual] {
+			add(driftFinding{Kind: driftMissingVpc, Resource: "Namespace", Name: ns.GetName(), Workspace: workspace, Actual: actual})
+		}
+	}
+
+	// vpcprefix为default时webhook不管理vpc
+	if svmate.vpcprefix != "default" {
+		for name, ws := range workspaces {
+			if !resolveFeature(policies, featureVpcLifecycle, policySubject{workspace: name, objectLabels: ws.GetLabels()}) {
+				continue
+			}
+			if expected := expectedVpc(name); expected != backend.defaultVpc() && !vpcs[expected] {
+				add(driftFinding{Kind: driftMissingVpc, Resource: "Workspace", Name: name, Workspace: name, Expected: expected})
+			}
+		}
+
+		// 只检查webhook创建的vpc，即带有本集群和业务空间label的vpc
+		for _, vpc := range vpcList {
+			labels := vpc.GetLabels()
+			workspace, ok := labels["kubesphere.io/workspace"]
+			if !ok || labels["kubesphere.io/cluster"] != svmate.cluster {
+				continue
+			}
+			if _, exist := workspaces[workspace]; !exist {
+				add(driftFinding{Kind: driftOrphanVpc, Resource: "VPC", Name: vpc.GetName(), Workspace: workspace})
+			} else if expected := expectedVpc(workspace); expected != vpc.GetName() {
+				add(driftFinding{Kind: driftOrphanVpc, Resource: "VPC", Name: vpc.GetName(), Workspace: workspace, Expected: expected})
+			}
+		}
+	}
+
+	sort.Slice(report.Findings, func(i, j int) bool {
+		a, b := report.Findings[i], report.Findings[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Resource != b.Resource {
+			return a.Resource < b.Resource
+		}
+		return a.Name < b.Name
+	})
+	return report, nil
+}
+
+func writeDriftReport(out io.Writer, report *driftReport, output string) error {
+	switch output {
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case "table":
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "KIND\tRESOURCE\tNAME\tWORKSPACE\tEXPECTED\tACTUAL")
+		for _, f := range report.Findings {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", f.Kind, f.Resource, f.Name, dash(f.Workspace), dash(f.Expected), dash(f.Actual))
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unsupported output %q", output)
+	}
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// report子命令的参数
+type reportParameters struct {
+	kubeconfig string
+	fixtures   sliceFlag // 使用清单代替集群，便于离线检查
+	output     string    // table或json
+	vpcprefix  string
+	cluster    string
+	workspaces sliceFlag
+	sdn        string
+}
+
+// 输出集群中与webhook规则不一致的业务空间、namespace和vpc，存在不一致时返回3
+func runReport(args []string) int {
+	var parameters reportParameters
+
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	fs.StringVar(&parameters.kubeconfig, "kubeconfig", "", "Path to a kubeconfig. Only required if out-of-cluster.")
+	fs.Var(&parameters.fixtures, "fixtures", "Check these manifest files or directories instead of a cluster.")
+	fs.StringVar(&parameters.output, "output", "table", "Output format: table or json.")
+	fs.StringVar(&parameters.vpcprefix, "vpcprefix", "default", "vpcprefix")
+	fs.StringVar(&parameters.cluster, "cluster", "poc", "cluster")
+	fs.Var(&parameters.workspaces, "ws", "abnormal workspaces,for example:shanlv,tuangou")
+	fs.StringVar(&parameters.sdn, "sdn", "yunshan", "SDN backing VPCs and subnets: yunshan, kube-ovn or calico.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	report, err := report(parameters)
+	if err == nil {
+		err = writeDriftReport(os.Stdout, report, parameters.output)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "report: %v\n", err)
+		return 1
+	}
+	if len(report.Findings) > 0 {
+		return 3
+	}
+	return 0
+}
+
+func report(parameters reportParameters) (*driftReport, error) {
+	backend, err := sdnBackendByName(parameters.sdn)
+	if err != nil {
+		return nil, err
+	}
+
+	var client Client
+	if len(parameters.fixtures) > 0 {
+		fixtures, err := loadFixtures(parameters.fixtures)
+		if err != nil {
+			return nil, err
+		}
+		fakeClient, err := newFakeClient(fixtures)
+		if err != nil {
+			return nil, err
+		}
+		client = Client{dynamicClient: fakeClient}
+	} else if client, err = newClient(parameters.kubeconfig); err != nil {
+		return nil, err
+	}
+	client.sdn = backend
+
+	return buildDriftReport(context.Background(), serverMate{
+		vpcprefix:  parameters.vpcprefix,
+		cluster:    parameters.cluster,
+		abnormalws: parameters.workspaces,
+		client:     client,
+	})
+}
+
+// /report接口，默认返回JSON，?output=table返回表格
+func (whsvr *WebhookServer) serveReport(w http.ResponseWriter, r *http.Request) {
+	output := r.URL.Query().Get("output")
+	if output == "" {
+		output = "json"
+	}
+	if output != "json" && output != "table" {
+		http.Error(w, fmt.Sprintf("unsupported output %q", output), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := whsvr.requestContext(r)
+	defer cancel()
+	report, err := buildDriftReport(ctx, serverMate{
+		vpcprefix:  whsvr.vpcprefix,
+		cluster:    whsvr.cluster,
+		abnormalws: whsvr.abnormalws,
+		client:     whsvr.client,
+	})
+	if err != nil {
+		glog.Errorf("Failed to build drift report: %v", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if output == "json" {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	if err := writeDriftReport(w, report, output); err != nil {
+		glog.Errorf("Failed to write drift report: %v", err)
+	}
+}
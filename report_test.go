@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDriftReport(t *testing.T) {
+	whsvr, _ := newTestServer(t, "k8s-poc", filepath.Join("testdata", "report"))
+	report, err := buildDriftReport(context.Background(), serverMate{
+		vpcprefix:  whsvr.vpcprefix,
+		cluster:    whsvr.cluster,
+		abnormalws: whsvr.abnormalws,
+		client:     whsvr.client,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []driftFinding{
+		{Kind: driftMissingVpc, Resource: "Namespace", Name: "firefly-gone", Workspace: "firefly", Actual: "k8s-poc-firefly"},
+		{Kind: driftMissingVpc, Resource: "Workspace", Name: "bigdata-usercenter2", Workspace: "bigdata-usercenter2", Expected: "bigdata-jh-ks"},
+		{Kind: driftMissingVpc, Resource: "Workspace", Name: "leo-test", Workspace: "leo-test", Expected: "k8s-poc-leo-test"},
+		{Kind: driftMissingVpc, Resource: "Workspace", Name: "midcloud", Workspace: "midcloud", Expected: "db-middleware"},
+		{Kind: driftMissingVpcLabel, Resource: "Namespace", Name: "kube-system", Workspace: "system-workspace", Expected: "default"},
+		{Kind: driftMissingVpcLabel, Resource: "Namespace", Name: "team-a", Workspace: "leo-test", Expected: "k8s-poc-leo-test"},
+		{Kind: driftMissingWorkspace, Resource: "Namespace", Name: "ghost", Workspace: "deleted-team"},
+		{Kind: driftOrphanVpc, Resource: "VPC", Name: "k8s-poc-deleted-team", Workspace: "deleted-team"},
+		{Kind: driftOrphanVpc, Resource: "VPC", Name: "k8s-poc-shanglv-legacy", Workspace: "shanglv", Expected: "shanglv"},
+		{Kind: driftWrongVpcLabel, Resource: "Namespace", Name: "firefly-gone", Workspace: "firefly", Expected: "default", Actual: "k8s-poc-firefly"},
+		{Kind: driftWrongVpcLabel, Resource: "Namespace", Name: "shanglv-web", Workspace: "shanglv", Expected: "shanglv", Actual: "k8s-poc-shanglv-legacy"},
+	}
+	if !reflect.DeepEqual(report.Findings, want) {
+		got, _ := json.MarshalIndent(report.Findings, "", "  ")
+		t.Errorf("findings:\n%s", got)
+	}
+
+	var table bytes.Buffer
+	if err := writeDriftReport(&table, report, "table"); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(table.String()), "\n")
+	if len(lines) != len(want)+1 || !strings.HasPrefix(lines[0], "KIND") {
+		t.Errorf("table:\n%s", table.String())
+	}
+	if fields := strings.Fields(lines[len(lines)-1]); !reflect.DeepEqual(fields, []string{"WrongVpcLabel", "Namespace", "shanglv-web", "shanglv", "shanglv", "k8s-poc-shanglv-legacy"}) {
+		t.Errorf("last row: %v", fields)
+	}
+}
+
+// vpcprefix为default时只检查namespace的label
+func TestDriftReportDefaultPrefix(t *testing.T) {
+	whsvr, _ := newTestServer(t, "default")
+	report, err := buildDriftReport(context.Background(), serverMate{vpcprefix: whsvr.vpcprefix, cluster: whsvr.cluster, client: whsvr.client})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range report.Findings {
+		if f.Kind != driftMissingVpcLabel || f.Expected != "default" {
+			t.Errorf("unexpected finding %+v", f)
+		}
+	}
+	if len(report.Findings) != 2 {
+		t.Errorf("got %d findings, want 2", len(report.Findings))
+	}
+}
+
+func TestServeReport(t *testing.T) {
+	whsvr, _ := newTestServer(t, "k8s-poc")
+
+	cases := []struct {
+		query       string
+		code        int
+		contentType string
+	}{
+		{query: "", code: http.StatusOK, contentType: "application/json"},
+		{query: "?output=table", code: http.StatusOK, contentType: "text/plain; charset=utf-8"},
+		{query: "?output=yaml", code: http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		whsvr.serveReport(rec, httptest.NewRequest(http.MethodGet, "/report"+c.query, nil))
+		if rec.Code != c.code {
+			t.Errorf("%q: code %d, want %d", c.query, rec.Code, c.code)
+			continue
+		}
+		if c.contentType != "" && rec.Header().Get("Content-Type") != c.contentType {
+			t.Errorf("%q: content type %q", c.query, rec.Header().Get("Content-Type"))
+		}
+	}
+}
@@ -0,0 +1,694 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/retry"
+)
+
+// sdn插件之间的差异: vpc和子网的资源、namespace与vpc的绑定方式以及申请固定ip的annotation
+// vpc的创建、删除以及子网的分配流程对所有插件相同
+type sdnBackend interface {
+	vpcResource() schema.GroupVersionResource
+	subnetResource() schema.GroupVersionResource
+	// sdn自带的vpc，vpcprefix为default以及system-workspace等业务空间使用
+	defaultVpc() string
+	// namespace绑定的vpc
+	namespaceVpc(ns metav1.Object) (string, bool)
+	// 将namespace绑定到vpc的patch，已经绑定时返回nil
+	bindNamespace(ns *metav1.ObjectMeta, vpc string) []patchOperation
+	// pod模板上申请固定ip的annotation
+	fixedIPsKey() string
+	// 多个pod能否使用同一组固定ip，不能时固定ip只注入单个pod的工作负载
+	sharedFixedIPs() bool
+	// 要创建的vpc对象，spec由vpc模板填写
+	newVpc(name string) *unstructured.Unstructured
+	// namespace关联的子网
+	namespaceSubnets(ctx context.Context, client dynamic.Interface, namespace string) ([]sdnSubnet, error)
+	// 网关使用的固定ip，按annotation的格式返回，dryRun时不预留地址
+	fixedIPs(ctx context.Context, client dynamic.Interface, subnet sdnSubnet, gateway gatewayRef, dryRun bool) (string, error)
+}
+
+// 每个网关独占固定ip的sdn，注入时为网关预留地址，网关删除后由leader释放
+type fixedIPReserver interface {
+	// 记录预留的资源
+	reservationResource() schema.GroupVersionResource
+	// 有预留地址的网关
+	reservedGateways(ctx context.Context, client dynamic.Interface) ([]gatewayRef, error)
+	// 删除网关的预留，返回释放的地址
+	releaseFixedIPs(ctx context.Context, client dynamic.Interface, gateway gatewayRef) ([]string, error)
+}
+
+// 注入固定ip的网关
+type gatewayRef struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+func (g gatewayRef) String() string {
+	return g.Kind + "/" + g.Namespace + "/" + g.Name
+}
+
+func parseGatewayRef(s string) (gatewayRef, bool) {
+	parts := strings.SplitN(s, "/", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return gatewayRef{}, false
+	}
+	return gatewayRef{Kind: parts[0], Namespace: parts[1], Name: parts[2]}, true
+}
+
+// 创建vpc时必须由模板设置的字段，按.分隔的路径，例如spec.cidr
+type vpcFieldsRequirer interface {
+	requiredVpcFields() []string
+}
+
+// 子网是集群级别的资源并通过spec.namespaces绑定namespace的sdn，缓存按namespace建立子网的索引
+type subnetIndexer interface {
+	subnetNamespaces(subnet *unstructured.Unstructured) ([]string, error)
+	subnetOf(subnet *unstructured.Unstructured) sdnSubnet
+}
+
+// namespace需要登记到vpc上才会使用vpc的sdn(Kube-OVN的Vpc.spec.namespaces)，namespace的label只用于记录
+// 只登记到webhook创建的vpc，sdn自带的vpc和手工创建的vpc由管理员维护
+type vpcMembership interface {
+	joinVpc(ctx context.Context, client dynamic.Interface, vpc, namespace string) error
+	leaveVpc(ctx context.Context, client dynamic.Interface, vpc, namespace string) error
+	vpcMembers(vpc *unstructured.Unstructured) []string
+}
+
+// webhook随业务空间创建的vpc带有业务空间的label
+func managedVpc(vpc metav1.Object) bool {
+	_, ok := vpc.GetLabels()[admissionWebhookWorkspaceKey]
+	return ok
+}
+
+// 支持为namespace自动创建子网的sdn
+type subnetProvisioner interface {
+	newSubnet(namespace, vpc, cidr string) *unstructured.Unstructured
+}
+
+func subnetProvisionerOf(backend sdnBackend) (subnetProvisioner, error) {
+	if provisioner, ok := backend.(subnetProvisioner); ok {
+		return provisioner, nil
+	}
+	return nil, fmt.Errorf("sdn %T does not support subnet provisioning", backend)
+}
+
+type sdnSubnet struct {
+	Name    string
+	CIDR    string
+	Gateway string
+}
+
+// 网关固定使用子网中的前15个地址
+const fixedIPCount = 15
+
+var sdnBackends = map[string]sdnBackend{
+	"yunshan":  yunshanBackend{},
+	"kube-ovn": kubeOVNBackend{},
+	"calico":   calicoBackend{},
+}
+
+func sdnBackendByName(name string) (sdnBackend, error) {
+	if backend, ok := sdnBackends[name]; ok {
+		return backend, nil
+	}
+	var names []string
+	for n := range sdnBackends {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown sdn %q, expect one of %s", name, strings.Join(names, ", "))
+}
+
+// sdn的资源必须在集群中提供，启动时检查，避免每个请求都因为资源不存在失败
+// Calico的projectcalico.org/v3只有安装了Calico API server才会提供
+func checkSDNResources(client discovery.DiscoveryInterface, backend sdnBackend) error {
+	required := []schema.GroupVersionResource{backend.vpcResource()}
+	if backend.subnetResource() != backend.vpcResource() {
+		required = append(required, backend.subnetResource())
+	}
+	if reserver, ok := backend.(fixedIPReserver); ok {
+		required = append(required, reserver.reservationResource())
+	}
+	served, err := servedResources(client, required)
+	if err != nil {
+		return err
+	}
+	for _, gvr := range required {
+		found := false
+		for _, s := range served {
+			found = found || s == gvr
+		}
+		if !found {
+			return fmt.Errorf("%s is not served by the cluster", gvr.GroupResource())
+		}
+	}
+	return nil
+}
+
+// 未指定sdn时使用云杉
+func (c *Client) backend() sdnBackend {
+	if c.sdn == nil {
+		return yunshanBackend{}
+	}
+	return c.sdn
+}
+
+// 通过namespace的label记录vpc
+func labelVpc(ns metav1.Object, key string) (string, bool) {
+	vpc, ok := ns.GetLabels()[key]
+	return vpc, ok
+}
+
+func bindLabel(ns *metav1.ObjectMeta, key, vpc string) []patchOperation {
+	if !checkLabel(ns, key, vpc) {
+		return nil
+	}
+	return updateLabels(ns.Labels, map[string]string{key: vpc})
+}
+
+// 从网段的网络地址之后按顺序取count个地址，跳过skip
+func subnetAddresses(cidr string, count int, skip string) (string, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return "", err
+	}
+	prefix = prefix.Masked()
+
+	var ips []string
+	for addr := prefix.Addr().Next(); len(ips) < count; addr = addr.Next() {
+		if !addr.IsValid() || !prefix.Contains(addr) {
+			return "", fmt.Errorf("subnet %s has fewer than %d addresses", cidr, count)
+		}
+		if addr.String() == skip {
+			continue
+		}
+		ips = append(ips, addr.String())
+	}
+	return strings.Join(ips, ","), nil
+}
+
+var (
+	vpcGVR    = schema.GroupVersionResource{Group: "nci.yunshan.net", Version: "v1", Resource: "vpcs"}
+	subnetGVR = schema.GroupVersionResource{Group: "nci.yunshan.net", Version: "v1", Resource: "subnets"}
+)
+
+// 云杉sdn: 子网在namespace中创建，vpc写在namespace的label上
+type yunshanBackend struct{}
+
+func (yunshanBackend) vpcResource() schema.GroupVersionResource    { return vpcGVR }
+func (yunshanBackend) subnetResource() schema.GroupVersionResource { return subnetGVR }
+func (yunshanBackend) defaultVpc() string                          { return "default" }
+func (yunshanBackend) fixedIPsKey() string                         { return admissionWebhookAnnotationsKey }
+func (yunshanBackend) sharedFixedIPs() bool                        { return true }
+
+func (yunshanBackend) namespaceVpc(ns metav1.Object) (string, bool) {
+	return labelVpc(ns, admissionWebhookLabelsKey)
+}
+
+func (yunshanBackend) bindNamespace(ns *metav1.ObjectMeta, vpc string) []patchOperation {
+	return bindLabel(ns, admissionWebhookLabelsKey, vpc)
+}
+
+func (yunshanBackend) newVpc(name string) *unstructured.Unstructured {
+	vpc := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "nci.yunshan.net/v1",
+			"kind":       "VPC",
+		},
+	}
+	vpc.SetName(name)
+	return vpc
+}
+
+func (yunshanBackend) namespaceSubnets(ctx context.Context, client dynamic.Interface, namespace string) ([]sdnSubnet, error) {
+	unStructData, err := client.Resource(subnetGVR).Namespace(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, transientError(err, msgSubnetLookupFailed, namespace)
+	}
+
+	var obj Nets
+
+	// 使用 runtime.DefaultUnstructuredConverter 转换 item 为对象
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(unStructData.UnstructuredContent(), &obj)
+	if err != nil {
+		return nil, internalError(err, msgSubnetConvertFailed, namespace)
+	}
+
+	var subnets []sdnSubnet
+	for _, item := range obj.Items {
+		subnets = append(subnets, sdnSubnet{Name: item.Name, CIDR: item.Spec.CIDR, Gateway: item.Spec.Gateway})
+	}
+	return subnets, nil
+}
+
+func (yunshanBackend) newSubnet(namespace, vpc, cidr string) *unstructured.Unstructured {
+	subnet := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "nci.yunshan.net/v1",
+			"kind":       "Subnet",
+			"spec": map[string]interface{}{
+				"cidr": cidr,
+			},
+		},
+	}
+	subnet.SetName(namespace + "-subnet")
+	subnet.SetNamespace(namespace)
+	return subnet
+}
+
+// 云杉的网关地址不在前15个地址中，namespace中的网关共用这些地址
+func (yunshanBackend) fixedIPs(_ context.Context, _ dynamic.Interface, subnet sdnSubnet, _ gatewayRef, _ bool) (string, error) {
+	return subnetAddresses(subnet.CIDR, fixedIPCount, "")
+}
+
+var (
+	kubeOVNVpcGVR    = schema.GroupVersionResource{Group: "kubeovn.io", Version: "v1", Resource: "vpcs"}
+	kubeOVNSubnetGVR = schema.GroupVersionResource{Group: "kubeovn.io", Version: "v1", Resource: "subnets"}
+)
+
+// Kube-OVN不使用namespace的label选择vpc，webhook用这个label记录namespace所属的vpc，
+// 并据此把namespace登记到Vpc的spec.namespaces
+const kubeOVNVpcLabel = "admission-webhook-ks.cmft/vpc"
+
+// Kube-OVN: vpc和子网都是集群级别的资源，Vpc和子网都通过spec.namespaces绑定namespace
+type kubeOVNBackend struct{}
+
+func (kubeOVNBackend) vpcResource() schema.GroupVersionResource    { return kubeOVNVpcGVR }
+func (kubeOVNBackend) subnetResource() schema.GroupVersionResource { return kubeOVNSubnetGVR }
+func (kubeOVNBackend) defaultVpc() string                          { return "ovn-cluster" }
+func (kubeOVNBackend) fixedIPsKey() string                         { return "ovn.kubernetes.io/ip_pool" }
+func (kubeOVNBackend) sharedFixedIPs() bool                        { return true }
+
+func (kubeOVNBackend) namespaceVpc(ns metav1.Object) (string, bool) {
+	return labelVpc(ns, kubeOVNVpcLabel)
+}
+
+func (kubeOVNBackend) bindNamespace(ns *metav1.ObjectMeta, vpc string) []patchOperation {
+	return bindLabel(ns, kubeOVNVpcLabel, vpc)
+}
+
+func (b kubeOVNBackend) joinVpc(ctx context.Context, client dynamic.Interface, vpc, namespace string) error {
+	return b.updateVpcMembers(ctx, client, vpc, func(members sliceFlag) (sliceFlag, bool) {
+		if members.has(namespace) {
+			return members, false
+		}
+		return append(members, namespace), true
+	})
+}
+
+func (b kubeOVNBackend) leaveVpc(ctx context.Context, client dynamic.Interface, vpc, namespace string) error {
+	return b.updateVpcMembers(ctx, client, vpc, func(members sliceFlag) (sliceFlag, bool) {
+		var kept sliceFlag
+		for _, member := range members {
+			if member != namespace {
+				kept = append(kept, member)
+			}
+		}
+		return kept, len(kept) != len(members)
+	})
+}
+
+func (kubeOVNBackend) vpcMembers(vpc *unstructured.Unstructured) []string {
+	members, _, _ := unstructured.NestedStringSlice(vpc.Object, "spec", "namespaces")
+	return members
+}
+
+// 不存在或者不是webhook创建的vpc不修改
+func (b kubeOVNBackend) updateVpcMembers(ctx context.Context, client dynamic.Interface, name string, update func(sliceFlag) (sliceFlag, bool)) error {
+	resource := client.Resource(kubeOVNVpcGVR)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		vpc, err := resource.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !managedVpc(vpc) {
+			return nil
+		}
+		members, changed := update(b.vpcMembers(vpc))
+		if !changed {
+			return nil
+		}
+		value := make([]interface{}, 0, len(members))
+		for _, member := range members {
+			value = append(value, member)
+		}
+		if err := unstructured.SetNestedSlice(vpc.Object, value, "spec", "namespaces"); err != nil {
+			return err
+		}
+		_, err = resource.Update(ctx, vpc, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func (kubeOVNBackend) newVpc(name string) *unstructured.Unstructured {
+	vpc := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "kubeovn.io/v1",
+			"kind":       "Vpc",
+		},
+	}
+	vpc.SetName(name)
+	return vpc
+}
+
+func (b kubeOVNBackend) namespaceSubnets(ctx context.Context, client dynamic.Interface, namespace string) ([]sdnSubnet, error) {
+	list, err := client.Resource(kubeOVNSubnetGVR).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, transientError(err, msgSubnetLookupFailed, namespace)
+	}
+
+	var subnets []sdnSubnet
+	for i := range list.Items {
+		item := &list.Items[i]
+		namespaces, err := b.subnetNamespaces(item)
+		if err != nil {
+			return nil, internalError(err, msgSubnetConvertFailed, namespace)
+		}
+		if sliceFlag(namespaces).has(namespace) {
+			subnets = append(subnets, b.subnetOf(item))
+		}
+	}
+	return subnets, nil
+}
+
+func (kubeOVNBackend) subnetNamespaces(subnet *unstructured.Unstructured) ([]string, error) {
+	namespaces, _, err := unstructured.NestedStringSlice(subnet.Object, "spec", "namespaces")
+	return namespaces, err
+}
+
+// 双栈子网的cidrBlock为"IPv4,IPv6"，使用第一个网段
+func (kubeOVNBackend) subnetOf(subnet *unstructured.Unstructured) sdnSubnet {
+	cidrBlock, _, _ := unstructured.NestedString(subnet.Object, "spec", "cidrBlock")
+	gateway, _, _ := unstructured.NestedString(subnet.Object, "spec", "gateway")
+	return sdnSubnet{
+		Name:    subnet.GetName(),
+		CIDR:    strings.Split(cidrBlock, ",")[0],
+		Gateway: strings.Split(gateway, ",")[0],
+	}
+}
+
+func (kubeOVNBackend) newSubnet(namespace, vpc, cidr string) *unstructured.Unstructured {
+	subnet := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "kubeovn.io/v1",
+			"kind":       "Subnet",
+			"spec": map[string]interface{}{
+				"cidrBlock":  cidr,
+				"vpc":        vpc,
+				"namespaces": []interface{}{namespace},
+			},
+		},
+	}
+	subnet.SetName(namespace + "-subnet")
+	return subnet
+}
+
+// Kube-OVN默认使用第一个地址作为网关，ip_pool中不能包含网关地址
+func (kubeOVNBackend) fixedIPs(_ context.Context, _ dynamic.Interface, subnet sdnSubnet, _ gatewayRef, _ bool) (string, error) {
+	gateway := subnet.Gateway
+	if gateway == "" {
+		prefix, err := netip.ParsePrefix(subnet.CIDR)
+		if err != nil {
+			return "", err
+		}
+		gateway = prefix.Masked().Addr().Next().String()
+	}
+	return subnetAddresses(subnet.CIDR, fixedIPCount, gateway)
+}
+
+var (
+	calicoIPPoolGVR        = schema.GroupVersionResource{Group: "projectcalico.org", Version: "v3", Resource: "ippools"}
+	calicoIPReservationGVR = schema.GroupVersionResource{Group: "projectcalico.org", Version: "v3", Resource: "ipreservations"}
+)
+
+const (
+	// namespace中的pod使用的IPPool，值为JSON数组
+	calicoPoolsAnnotation = "cni.projectcalico.org/ipv4pools"
+	// pod使用的固定ip，值为JSON数组，每个地址族只能有一个地址
+	calicoIPAddrsAnnotation = "cni.projectcalico.org/ipAddrs"
+	// webhook为网关创建的IPReservation
+	calicoReservationLabel = "admission-webhook-ks.cmft/fixed-ip"
+	// 预留地址的网关，格式为Kind/namespace/name
+	calicoGatewayAnnotation = "admission-webhook-ks.cmft/gateway"
+)
+
+// Calico: 每个业务空间一个IPPool，namespace通过annotation选择IPPool，IPPool的网段由vpc模板设置
+// 使用projectcalico.org/v3而不是crd.projectcalico.org/v1，由Calico API server校验并填写默认值，
+// 直接写CRD不受Calico支持
+type calicoBackend struct{}
+
+func (calicoBackend) vpcResource() schema.GroupVersionResource    { return calicoIPPoolGVR }
+func (calicoBackend) subnetResource() schema.GroupVersionResource { return calicoIPPoolGVR }
+func (calicoBackend) defaultVpc() string                          { return "default-ipv4-ippool" }
+func (calicoBackend) fixedIPsKey() string                         { return calicoIPAddrsAnnotation }
+func (calicoBackend) sharedFixedIPs() bool                        { return false }
+
+// IPPool没有默认网段，缺少spec.cidr时apiserver拒绝创建
+func (calicoBackend) requiredVpcFields() []string { return []string{"spec.cidr"} }
+
+func (calicoBackend) reservationResource() schema.GroupVersionResource {
+	return calicoIPReservationGVR
+}
+
+func calicoPools(ns metav1.Object) []string {
+	var pools []string
+	if value, ok := ns.GetAnnotations()[calicoPoolsAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &pools); err != nil {
+			glog.Warningf("Invalid %s of namespace %s: %v", calicoPoolsAnnotation, ns.GetName(), err)
+		}
+	}
+	return pools
+}
+
+func (calicoBackend) namespaceVpc(ns metav1.Object) (string, bool) {
+	pools := calicoPools(ns)
+	if len(pools) == 0 {
+		return "", false
+	}
+	return pools[0], true
+}
+
+func (calicoBackend) bindNamespace(ns *metav1.ObjectMeta, vpc string) []patchOperation {
+	value, _ := json.Marshal([]string{vpc})
+	if ns.Annotations[calicoPoolsAnnotation] == string(value) {
+		return nil
+	}
+
+	annotations := make(map[string]string)
+	for k, v := range ns.Annotations {
+		annotations[k] = v
+	}
+	annotations[calicoPoolsAnnotation] = string(value)
+	return []patchOperation{{Op: "add", Path: "/metadata/annotations", Value: annotations}}
+}
+
+func (calicoBackend) newVpc(name string) *unstructured.Unstructured {
+	pool := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "projectcalico.org/v3",
+			"kind":       "IPPool",
+		},
+	}
+	pool.SetName(name)
+	return pool
+}
+
+// namespace的IPPool，不存在的IPPool忽略
+func (calicoBackend) namespaceSubnets(ctx context.Context, client dynamic.Interface, namespace string) ([]sdnSubnet, error) {
+	ns, err := client.Resource(namespaceGVR).Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return nil, transientError(err, msgSubnetLookupFailed, namespace)
+	}
+
+	var subnets []sdnSubnet
+	for _, name := range calicoPools(ns) {
+		pool, err := client.Resource(calicoIPPoolGVR).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, transientError(err, msgSubnetLookupFailed, namespace)
+		}
+		cidr, _, _ := unstructured.NestedString(pool.Object, "spec", "cidr")
+		subnets = append(subnets, sdnSubnet{Name: name, CIDR: cidr})
+	}
+	return subnets, nil
+}
+
+// Calico每个pod只能指定一个IPv4地址，每个单副本的网关从IPPool的前15个地址中独占一个
+// 地址通过IPReservation预留，IPAM不会再把它自动分配给其他pod，ipAddrs指定的地址不受预留限制
+func (calicoBackend) fixedIPs(ctx context.Context, client dynamic.Interface, subnet sdnSubnet, gateway gatewayRef, dryRun bool) (string, error) {
+	prefix, err := netip.ParsePrefix(subnet.CIDR)
+	if err != nil {
+		return "", err
+	}
+	prefix = prefix.Masked()
+
+	reservations := client.Resource(calicoIPReservationGVR)
+	list, err := calicoReservations(ctx, client)
+	if err != nil {
+		return "", transientError(err, msgFixedIPReserveFailed, gateway)
+	}
+	reserved := make(map[netip.Addr]bool)
+	for _, item := range list {
+		for _, addr := range calicoReservedAddrs(item) {
+			if !prefix.Contains(addr) {
+				continue
+			}
+			// 网关已经预留过地址
+			if item.GetAnnotations()[calicoGatewayAnnotation] == gateway.String() {
+				return calicoIPAddrs(addr)
+			}
+			reserved[addr] = true
+		}
+	}
+
+	addr := prefix.Addr()
+	for i := 0; i < fixedIPCount; i++ {
+		if addr = addr.Next(); !addr.IsValid() || !prefix.Contains(addr) {
+			break
+		}
+		if reserved[addr] {
+			continue
+		}
+		// 预留之前已经由IPAM分配给pod的地址
+		inUse, err := podUsesIP(ctx, client, addr.String())
+		if err != nil {
+			return "", transientError(err, msgFixedIPReserveFailed, gateway)
+		}
+		if inUse {
+			continue
+		}
+		if dryRun {
+			return calicoIPAddrs(addr)
+		}
+
+		// 以地址命名，多个副本同时预留同一个地址时只有一个能创建成功
+		_, err = reservations.Create(ctx, newCalicoReservation(addr, gateway), metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			continue
+		}
+		if err != nil {
+			return "", transientError(err, msgFixedIPReserveFailed, gateway)
+		}
+		glog.Infof("Reserved %s for gateway %s", addr, gateway)
+		return calicoIPAddrs(addr)
+	}
+	return "", policyViolation(msgFixedIPsExhausted, subnet.Name, fixedIPCount, gateway)
+}
+
+func (calicoBackend) reservedGateways(ctx context.Context, client dynamic.Interface) ([]gatewayRef, error) {
+	list, err := calicoReservations(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	var gateways []gatewayRef
+	seen := make(map[gatewayRef]bool)
+	for _, item := range list {
+		gateway, ok := parseGatewayRef(item.GetAnnotations()[calicoGatewayAnnotation])
+		if ok && !seen[gateway] {
+			seen[gateway] = true
+			gateways = append(gateways, gateway)
+		}
+	}
+	return gateways, nil
+}
+
+func (calicoBackend) releaseFixedIPs(ctx context.Context, client dynamic.Interface, gateway gatewayRef) ([]string, error) {
+	list, err := calicoReservations(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	var released []string
+	for _, item := range list {
+		if item.GetAnnotations()[calicoGatewayAnnotation] != gateway.String() {
+			continue
+		}
+		err := client.Resource(calicoIPReservationGVR).Delete(ctx, item.GetName(), metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return released, err
+		}
+		for _, addr := range calicoReservedAddrs(item) {
+			released = append(released, addr.String())
+		}
+	}
+	return released, nil
+}
+
+// webhook为网关创建的IPReservation
+func calicoReservations(ctx context.Context, client dynamic.Interface) ([]unstructured.Unstructured, error) {
+	list, err := client.Resource(calicoIPReservationGVR).List(ctx, metav1.ListOptions{LabelSelector: calicoReservationLabel + "=true"})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func calicoReservedAddrs(reservation unstructured.Unstructured) []netip.Addr {
+	var addrs []netip.Addr
+	cidrs, _, _ := unstructured.NestedStringSlice(reservation.Object, "spec", "reservedCIDRs")
+	for _, cidr := range cidrs {
+		if p, err := netip.ParsePrefix(cidr); err == nil {
+			addrs = append(addrs, p.Addr())
+		}
+	}
+	return addrs
+}
+
+func calicoIPAddrs(addr netip.Addr) (string, error) {
+	value, err := json.Marshal([]string{addr.String()})
+	return string(value), err
+}
+
+func calicoReservationName(addr netip.Addr) string {
+	return "ks-gateway-" + strings.NewReplacer(".", "-", ":", "-").Replace(addr.String())
+}
+
+func newCalicoReservation(addr netip.Addr, gateway gatewayRef) *unstructured.Unstructured {
+	reservation := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "projectcalico.org/v3",
+			"kind":       "IPReservation",
+			"spec": map[string]interface{}{
+				"reservedCIDRs": []interface{}{netip.PrefixFrom(addr, addr.BitLen()).String()},
+			},
+		},
+	}
+	reservation.SetName(calicoReservationName(addr))
+	reservation.SetLabels(map[string]string{calicoReservationLabel: "true"})
+	reservation.SetAnnotations(map[string]string{calicoGatewayAnnotation: gateway.String()})
+	return reservation
+}
+
+// 地址是否被pod使用，fieldSelector之外再比较一次，不支持fieldSelector的客户端会返回所有pod
+func podUsesIP(ctx context.Context, client dynamic.Interface, ip string) (bool, error) {
+	pods, err := client.Resource(podGVR).List(ctx, metav1.ListOptions{FieldSelector: "status.podIP=" + ip})
+	if err != nil {
+		return false, err
+	}
+	for _, pod := range pods.Items {
+		if podIP, _, _ := unstructured.NestedString(pod.Object, "status", "podIP"); podIP == ip {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestFixedIPs(t *testing.T) {
+	cases := []struct {
+		name    string
+		backend sdnBackend
+		subnet  sdnSubnet
+		first   string
+		last    string
+	}{
+		{name: "yunshan", backend: yunshanBackend{}, subnet: sdnSubnet{CIDR: "10.64.88.0/24"}, first: "10.64.88.1", last: "10.64.88.15"},
+		{name: "kube-ovn default gateway", backend: kubeOVNBackend{}, subnet: sdnSubnet{CIDR: "10.16.0.0/24"}, first: "10.16.0.2", last: "10.16.0.16"},
+		{name: "kube-ovn gateway", backend: kubeOVNBackend{}, subnet: sdnSubnet{CIDR: "10.16.0.0/24", Gateway: "10.16.0.5"}, first: "10.16.0.1", last: "10.16.0.16"},
+		{name: "ipv6", backend: kubeOVNBackend{}, subnet: sdnSubnet{CIDR: "fd00:10:16::/120"}, first: "fd00:10:16::2", last: "fd00:10:16::10"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ips, err := c.backend.fixedIPs(context.Background(), nil, c.subnet, gatewayRef{}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			list := sliceFlag{}
+			if err := list.Set(ips); err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != fixedIPCount || list[0] != c.first || list[len(list)-1] != c.last || list.has(c.subnet.Gateway) {
+				t.Errorf("got %s", ips)
+			}
+		})
+	}
+
+	if _, err := (yunshanBackend{}).fixedIPs(context.Background(), nil, sdnSubnet{CIDR: "10.64.88.0/29"}, gatewayRef{}, false); err == nil {
+		t.Error("expected an error for a subnet smaller than the fixed ips")
+	}
+}
+
+// 使用Kube-OVN时webhook读写kubeovn.io的资源，label和annotation也随之变化
+func TestKubeOVNBackend(t *testing.T) {
+	whsvr, fakeClient := newTestServer(t, "k8s-poc", filepath.Join("testdata", "kube-ovn"))
+	whsvr.client.sdn = kubeOVNBackend{}
+
+	patchOf := func(manifest string) []patchOperation {
+		t.Helper()
+		ar, err := simulatedReview([]byte(manifest), "CREATE")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := whsvr.mutate(context.Background(), ar, localeEn)
+		if !resp.Allowed {
+			t.Fatalf("denied: %v", resp.Result.Message)
+		}
+		var patch []patchOperation
+		if len(resp.Patch) > 0 {
+			if err := json.Unmarshal(resp.Patch, &patch); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return patch
+	}
+
+	patch := patchOf(`
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: team-c
+  labels:
+    kubesphere.io/workspace: leo-test
+`)
+	if len(patch) != 1 || patch[0].Value.(map[string]interface{})[kubeOVNVpcLabel] != "k8s-poc-leo-test" {
+		t.Errorf("namespace patch %+v", patch)
+	}
+	// Kube-OVN通过Vpc的spec.namespaces选择vpc
+	vpc, err := fakeClient.Resource(kubeOVNVpcGVR).Get(context.TODO(), "k8s-poc-leo-test", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if members := (kubeOVNBackend{}).vpcMembers(vpc); !reflect.DeepEqual(members, []string{"team-a", "team-c"}) {
+		t.Errorf("vpc namespaces %v", members)
+	}
+
+	patch = patchOf(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: kubesphere-router-team-a
+  namespace: team-a
+  labels:
+    app.kubernetes.io/component: controller
+    app.kubernetes.io/name: ingress-nginx
+`)
+	if len(patch) != 1 || patch[0].Value.(map[string]interface{})["ovn.kubernetes.io/ip_pool"] == nil {
+		t.Errorf("deployment patch %+v", patch)
+	}
+
+	patchOf(`
+apiVersion: tenant.kubesphere.io/v1alpha1
+kind: Workspace
+metadata:
+  name: payments
+`)
+	vpc, err = fakeClient.Resource(kubeOVNVpcGVR).Get(context.TODO(), "k8s-poc-payments", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vpc.GetKind() != "Vpc" || vpc.GetLabels()["kubesphere.io/workspace"] != "payments" {
+		t.Errorf("unexpected vpc %v", vpc.Object)
+	}
+}
+
+func TestKubeOVNSubnetController(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{kubeOVNVpcLabel: "k8s-poc-a"}},
+	})
+	dynamicClient, err := newFakeClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parameters subnetParameters
+	if err := parameters.supernets.Set("*=10.16.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	parameters.prefixLength = 24
+	parameters.configMap = "ks-webhook-subnet-allocations"
+	audit, err := newAuditLogger("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newSubnetController(Client{dynamicClient: dynamicClient, kubeClient: kubeClient, sdn: kubeOVNBackend{}}, parameters, "kube-system", audit)
+	ctx := context.TODO()
+
+	if err := c.reconcile(ctx, "team-a"); err != nil {
+		t.Fatal(err)
+	}
+	subnet, err := dynamicClient.Resource(kubeOVNSubnetGVR).Get(ctx, "team-a-subnet", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cidr, _, _ := unstructured.NestedString(subnet.Object, "spec", "cidrBlock")
+	vpc, _, _ := unstructured.NestedString(subnet.Object, "spec", "vpc")
+	namespaces, _, _ := unstructured.NestedStringSlice(subnet.Object, "spec", "namespaces")
+	if cidr != "10.16.0.0/24" || vpc != "k8s-poc-a" || len(namespaces) != 1 || namespaces[0] != "team-a" {
+		t.Errorf("unexpected subnet %v", subnet.Object)
+	}
+
+	// 集群级别的子网在namespace删除后由webhook删除
+	if err := kubeClient.CoreV1().Namespaces().Delete(ctx, "team-a", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.reconcile(ctx, "team-a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dynamicClient.Resource(kubeOVNSubnetGVR).Get(ctx, "team-a-subnet", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("subnet of the deleted namespace still exists: %v", err)
+	}
+}
+
+// 使用Calico时namespace通过annotation选择IPPool，业务空间的vpc是IPPool
+func TestCalicoBackend(t *testing.T) {
+	whsvr, fakeClient := newTestServer(t, "k8s-poc", filepath.Join("testdata", "calico"))
+	whsvr.client.sdn = calicoBackend{}
+
+	patchOf := func(manifest string) []patchOperation {
+		t.Helper()
+		ar, err := simulatedReview([]byte(manifest), "CREATE")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := whsvr.mutate(context.Background(), ar, localeEn)
+		if !resp.Allowed {
+			t.Fatalf("denied: %v", resp.Result.Message)
+		}
+		var patch []patchOperation
+		if len(resp.Patch) > 0 {
+			if err := json.Unmarshal(resp.Patch, &patch); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return patch
+	}
+
+	patch := patchOf(`
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: team-c
+  labels:
+    kubesphere.io/workspace: leo-test
+  annotations:
+    owner: leo
+`)
+	if len(patch) != 1 || patch[0].Path != "/metadata/annotations" {
+		t.Fatalf("namespace patch %+v", patch)
+	}
+	annotations := patch[0].Value.(map[string]interface{})
+	if annotations[calicoPoolsAnnotation] != `["k8s-poc-leo-test"]` || annotations["owner"] != "leo" {
+		t.Errorf("namespace annotations %v", annotations)
+	}
+
+	// 已经选择了业务空间的IPPool时不修改
+	if patch := patchOf(`
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: team-p
+  labels:
+    kubesphere.io/workspace: leo-test
+  annotations:
+    cni.projectcalico.org/ipv4pools: '["k8s-poc-leo-test"]'
+`); len(patch) != 0 {
+		t.Errorf("bound namespace patched: %+v", patch)
+	}
+
+	patch = patchOf(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: kubesphere-router-team-p
+  namespace: team-p
+  labels:
+    app.kubernetes.io/component: controller
+    app.kubernetes.io/name: ingress-nginx
+`)
+	if len(patch) != 1 || patch[0].Value.(map[string]interface{})[calicoIPAddrsAnnotation] != `["10.32.0.1"]` {
+		t.Errorf("deployment patch %+v", patch)
+	}
+	reservation, err := fakeClient.Resource(calicoIPReservationGVR).Get(context.TODO(), "ks-gateway-10-32-0-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cidrs, _, _ := unstructured.NestedStringSlice(reservation.Object, "spec", "reservedCIDRs")
+	if len(cidrs) != 1 || cidrs[0] != "10.32.0.1/32" || reservation.GetAnnotations()[calicoGatewayAnnotation] != "Deployment/team-p/kubesphere-router-team-p" {
+		t.Errorf("unexpected reservation %v", reservation.Object)
+	}
+
+	// 其他网关跳过已经预留以及已经分配给pod的地址，同一个网关再次注入时使用已经预留的地址
+	used := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   map[string]interface{}{"name": "web-0", "namespace": "team-c"},
+		"status":     map[string]interface{}{"podIP": "10.32.0.2"},
+	}}
+	if _, err := fakeClient.Resource(podGVR).Namespace("team-c").Create(context.TODO(), used, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	patch = patchOf(`
+apiVersion: v1
+kind: Pod
+metadata:
+  name: kubesphere-router-team-c
+  namespace: team-p
+  labels:
+    app.kubernetes.io/component: controller
+    app.kubernetes.io/name: ingress-nginx
+`)
+	if len(patch) != 1 || patch[0].Value.(map[string]interface{})[calicoIPAddrsAnnotation] != `["10.32.0.3"]` {
+		t.Errorf("pod patch %+v", patch)
+	}
+	patch = patchOf(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: kubesphere-router-team-p
+  namespace: team-p
+  labels:
+    app.kubernetes.io/component: controller
+    app.kubernetes.io/name: ingress-nginx
+`)
+	if len(patch) != 1 || patch[0].Value.(map[string]interface{})[calicoIPAddrsAnnotation] != `["10.32.0.1"]` {
+		t.Errorf("deployment patch %+v", patch)
+	}
+	reservations, err := fakeClient.Resource(calicoIPReservationGVR).List(context.TODO(), metav1.ListOptions{})
+	if err != nil || len(reservations.Items) != 2 {
+		t.Errorf("reservations %v: %v", reservations, err)
+	}
+
+	// dryRun时不创建预留
+	subnet := sdnSubnet{Name: "k8s-poc-leo-test", CIDR: "10.32.0.0/24"}
+	ips, err := (calicoBackend{}).fixedIPs(context.TODO(), fakeClient, subnet, gatewayRef{Kind: "Pod", Namespace: "team-p", Name: "router"}, true)
+	if err != nil || ips != `["10.32.0.4"]` {
+		t.Errorf("dry-run fixed ips %s: %v", ips, err)
+	}
+	if _, err := fakeClient.Resource(calicoIPReservationGVR).Get(context.TODO(), "ks-gateway-10-32-0-4", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("dry-run reserved an address: %v", err)
+	}
+
+	// 前15个地址都被占用时拒绝
+	subnet.CIDR = "10.32.0.0/30"
+	if _, err := (calicoBackend{}).fixedIPs(context.TODO(), fakeClient, subnet, gatewayRef{Kind: "Pod", Namespace: "team-p", Name: "router"}, false); err == nil {
+		t.Error("expected an error when the pool has no free address")
+	}
+
+	// 每个pod独占固定ip，多副本的网关和DaemonSet不注入，扩容时去掉已经注入的地址
+	if patch := patchOf(`
+apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: kubesphere-router-edge
+  namespace: team-p
+  labels:
+    app.kubernetes.io/component: controller
+    app.kubernetes.io/name: ingress-nginx
+`); len(patch) != 0 {
+		t.Errorf("daemonset patched: %+v", patch)
+	}
+	patch = patchOf(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: kubesphere-router-team-p
+  namespace: team-p
+  labels:
+    app.kubernetes.io/component: controller
+    app.kubernetes.io/name: ingress-nginx
+spec:
+  replicas: 2
+  template:
+    metadata:
+      annotations:
+        cni.projectcalico.org/ipAddrs: '["10.32.0.1"]'
+`)
+	if len(patch) != 1 || patch[0].Op != "remove" || patch[0].Path != "/spec/template/metadata/annotations/cni.projectcalico.org~1ipAddrs" {
+		t.Errorf("scaled deployment patch %+v", patch)
+	}
+
+	// 没有模板设置网段时IPPool不能创建
+	workspace := []byte(`
+apiVersion: tenant.kubesphere.io/v1alpha1
+kind: Workspace
+metadata:
+  name: payments
+`)
+	ar, err := simulatedReview(workspace, "CREATE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := whsvr.mutate(context.Background(), ar, localeEn); resp.Allowed || resp.Result.Code != http.StatusForbidden || !strings.Contains(resp.Result.Message, "spec.cidr") {
+		t.Errorf("workspace without a pool cidr: %+v", resp.Result)
+	}
+	if _, err := fakeClient.Resource(calicoIPPoolGVR).Get(context.TODO(), "k8s-poc-payments", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("ippool created without a cidr: %v", err)
+	}
+
+	templates := filepath.Join(t.TempDir(), "vpc-templates.yaml")
+	if err := os.WriteFile(templates, []byte("templates:\n- name: payments\n  template: |\n    spec:\n      cidr: 10.33.0.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if whsvr.vpcTemplates, err = loadVpcTemplates(templates); err != nil {
+		t.Fatal(err)
+	}
+	patchOf(string(workspace))
+	pool, err := fakeClient.Resource(calicoIPPoolGVR).Get(context.TODO(), "k8s-poc-payments", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cidr, _, _ := unstructured.NestedString(pool.Object, "spec", "cidr"); pool.GetKind() != "IPPool" || pool.GetLabels()["kubesphere.io/workspace"] != "payments" || cidr != "10.33.0.0/24" {
+		t.Errorf("unexpected ippool %v", pool.Object)
+	}
+
+	// IPPool的网段由vpc模板设置，webhook不为namespace创建子网
+	if _, err := subnetProvisionerOf(calicoBackend{}); err == nil {
+		t.Error("calico should not provision subnets")
+	}
+}
+
+// Calico的projectcalico.org/v3需要Calico API server，没有安装时启动失败
+func TestCheckSDNResources(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset()
+	kubeClient.Resources = []*metav1.APIResourceList{
+		{GroupVersion: "nci.yunshan.net/v1", APIResources: []metav1.APIResource{{Name: "vpcs"}, {Name: "subnets"}}},
+		{GroupVersion: "crd.projectcalico.org/v1", APIResources: []metav1.APIResource{{Name: "ippools"}}},
+	}
+	if err := checkSDNResources(kubeClient.Discovery(), yunshanBackend{}); err != nil {
+		t.Error(err)
+	}
+	if err := checkSDNResources(kubeClient.Discovery(), calicoBackend{}); err == nil {
+		t.Error("expected an error without the Calico API server")
+	}
+	if err := checkSDNResources(kubeClient.Discovery(), kubeOVNBackend{}); err == nil {
+		t.Error("expected an error without kubeovn.io")
+	}
+}
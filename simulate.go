@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	v1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clienttesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/yaml"
+)
+
+// simulate子命令的参数
+type simulateParameters struct {
+	input        string    // AdmissionReview或资源清单，"-"表示标准输入
+	fixtures     sliceFlag // 描述集群中Workspace、VPC、Subnet的清单文件或目录
+	operation    string    // 使用资源清单时模拟的操作
+	output       string    // 输出格式: patch或object
+	vpcprefix    string
+	cluster      string
+	workspaces   sliceFlag
+	locale       string
+	vpcTemplates string // vpc模板文件
+	sdn          string
+}
+
+// 离线运行准入流程，输出准入结果和patch
+func runSimulate(args []string) int {
+	var parameters simulateParameters
+
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	fs.StringVar(&parameters.input, "f", "-", "AdmissionReview or Namespace/Deployment/Workspace manifest to admit, \"-\" for stdin.")
+	fs.Var(&parameters.fixtures, "fixtures", "Comma separated files or directories with the Workspaces, VPCs and Subnets of the simulated cluster.")
+	fs.StringVar(&parameters.operation, "operation", "CREATE", "Admission operation used when the input is a plain manifest.")
+	fs.StringVar(&parameters.output, "output", "patch", "Output format: patch or object.")
+	fs.StringVar(&parameters.vpcprefix, "vpcprefix", "default", "vpcprefix")
+	fs.StringVar(&parameters.cluster, "cluster", "poc", "cluster")
+	fs.Var(&parameters.workspaces, "ws", "abnormal workspaces,for example:shanlv,tuangou")
+	fs.StringVar(&parameters.locale, "locale", "zh", "Locale of user-facing messages: zh or en.")
+	fs.StringVar(&parameters.vpcTemplates, "vpc-templates", "", "File with the VPC spec templates selected per workspace.")
+	fs.StringVar(&parameters.sdn, "sdn", "yunshan", "SDN backing VPCs and subnets: yunshan, kube-ovn or calico.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if err := simulate(parameters, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "simulate: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func simulate(parameters simulateParameters, out io.Writer) error {
+	loc, ok := parseLocale(parameters.locale)
+	if !ok {
+		return fmt.Errorf("unsupported locale %q", parameters.locale)
+	}
+	if parameters.output != "patch" && parameters.output != "object" {
+		return fmt.Errorf("unsupported output %q", parameters.output)
+	}
+
+	data, err := readInput(parameters.input)
+	if err != nil {
+		return err
+	}
+
+	ar, err := simulatedReview(data, v1.Operation(parameters.operation))
+	if err != nil {
+		return err
+	}
+
+	vpcTemplates, err := loadVpcTemplates(parameters.vpcTemplates)
+	if err != nil {
+		return err
+	}
+	backend, err := sdnBackendByName(parameters.sdn)
+	if err != nil {
+		return err
+	}
+
+	fixtures, err := loadFixtures(parameters.fixtures)
+	if err != nil {
+		return err
+	}
+	if namespace := ar.Request.Namespace; namespace != "" && !hasNamespace(fixtures, namespace) {
+		fmt.Fprintf(os.Stderr, "simulate: namespace %q is not in the fixtures, simulating it without labels\n", namespace)
+		fixtures = append(fixtures, simulatedNamespace(namespace))
+	}
+	fakeClient, err := newFakeClient(fixtures)
+	if err != nil {
+		return err
+	}
+
+	whsvr := &WebhookServer{
+		vpcprefix:    parameters.vpcprefix,
+		abnormalws:   parameters.workspaces,
+		cluster:      parameters.cluster,
+		locale:       loc,
+		features:     allFeatures,
+		client:       Client{dynamicClient: fakeClient, sdn: backend},
+		vpcTemplates: vpcTemplates,
+	}
+	resp := whsvr.mutate(context.Background(), ar, loc)
+
+	if parameters.output == "object" && resp.Allowed {
+		return printPatchedObject(out, ar.Request, resp)
+	}
+	printDecision(out, resp)
+	printSideEffects(out, fakeClient.Actions())
+	return nil
+}
+
+func hasNamespace(fixtures []*unstructured.Unstructured, name string) bool {
+	for _, obj := range fixtures {
+		if obj.GroupVersionKind().GroupKind() == (schema.GroupKind{Kind: "Namespace"}) && obj.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 请求所在的namespace一定存在，没有提供时生成一个不带标签的namespace，
+// 否则查询namespace的标签会失败，工作负载被当作依赖不可用拒绝
+func simulatedNamespace(name string) *unstructured.Unstructured {
+	ns := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Namespace",
+		},
+	}
+	ns.SetName(name)
+	return ns
+}
+
+func readInput(input string) ([]byte, error) {
+	if input == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(input)
+}
+
+// 输入为AdmissionReview时直接使用，为资源清单时构造AdmissionReview
+func simulatedReview(data []byte, op v1.Operation) (*v1.AdmissionReview, error) {
+	raw, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var obj unstructured.Unstructured
+	if err := obj.UnmarshalJSON(raw); err != nil {
+		return nil, err
+	}
+
+	if obj.GetKind() == "AdmissionReview" {
+		decoded, _, err := deserializer.Decode(raw, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		ar, err := admissionReviewFromObject(decoded)
+		if err != nil {
+			return nil, err
+		}
+		if ar.Request == nil {
+			return nil, fmt.Errorf("admission review can't be used: Request field is nil")
+		}
+		return ar, nil
+	}
+
+	gvk := obj.GroupVersionKind()
+	gvr, _ := meta.UnsafeGuessKindToResource(gvk)
+
+	req := &v1.AdmissionRequest{
+		UID:       types.UID("simulate"),
+		Kind:      metav1.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind},
+		Resource:  metav1.GroupVersionResource{Group: gvr.Group, Version: gvr.Version, Resource: gvr.Resource},
+		Name:      obj.GetName(),
+		Namespace: obj.GetNamespace(),
+		Operation: op,
+		UserInfo:  authenticationv1.UserInfo{Username: "simulate"},
+	}
+	if op == v1.Delete {
+		req.OldObject = runtime.RawExtension{Raw: raw}
+	} else {
+		req.Object = runtime.RawExtension{Raw: raw}
+	}
+
+	return &v1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{Kind: "AdmissionReview", APIVersion: v1.SchemeGroupVersion.String()},
+		Request:  req,
+	}, nil
+}
+
+func printDecision(out io.Writer, resp *v1.AdmissionResponse) {
+	fmt.Fprintf(out, "Allowed: %v\n", resp.Allowed)
+	if resp.Result != nil {
+		fmt.Fprintf(out, "Code:    %d\n", resp.Result.Code)
+		fmt.Fprintf(out, "Reason:  %s\n", resp.Result.Reason)
+		fmt.Fprintf(out, "Message: %s\n", resp.Result.Message)
+	}
+	for _, warning := range resp.Warnings {
+		fmt.Fprintf(out, "Warning: %s\n", warning)
+	}
+	if len(resp.Patch) > 0 {
+		fmt.Fprintf(out, "Patch:   %s\n", resp.Patch)
+	}
+}
+
+// 输出模拟过程中对集群资源的修改，例如创建或删除VPC
+func printSideEffects(out io.Writer, actions []clienttesting.Action) {
+	for _, effect := range sideEffects(actions) {
+		fmt.Fprintf(out, "Side effect: %s\n", effect)
+	}
+}
+
+// 将DynamicClient上的写操作整理为"verb resource name"的形式
+func sideEffects(actions []clienttesting.Action) []string {
+	mutating := sets.NewString("create", "update", "patch", "delete")
+
+	var effects []string
+	for _, action := range actions {
+		if !mutating.Has(action.GetVerb()) {
+			continue
+		}
+
+		name := ""
+		switch a := action.(type) {
+		case clienttesting.CreateAction:
+			if obj, ok := a.GetObject().(*unstructured.Unstructured); ok {
+				name = obj.GetName()
+			}
+		case clienttesting.DeleteAction:
+			name = a.GetName()
+		case clienttesting.PatchAction:
+			name = a.GetName()
+		}
+		effects = append(effects, fmt.Sprintf("%s %s %s", action.GetVerb(), action.GetResource().Resource, name))
+	}
+	return effects
+}
+
+// 将patch应用到请求的对象上并以YAML输出
+func printPatchedObject(out io.Writer, req *v1.AdmissionRequest, resp *v1.AdmissionResponse) error {
+	object := req.Object.Raw
+	if len(object) == 0 {
+		return fmt.Errorf("request carries no object to patch")
+	}
+
+	if len(resp.Patch) > 0 {
+		patch, err := jsonpatch.DecodePatch(resp.Patch)
+		if err != nil {
+			return err
+		}
+		if object, err = patch.Apply(object); err != nil {
+			return err
+		}
+	}
+
+	var pretty map[string]interface{}
+	if err := json.Unmarshal(object, &pretty); err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(pretty)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(data)
+	return err
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func simulateManifest(t *testing.T, manifest string, parameters simulateParameters) string {
+	t.Helper()
+	input := filepath.Join(t.TempDir(), "input.yaml")
+	if err := os.WriteFile(input, []byte(manifest), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	parameters.input = input
+	parameters.fixtures = sliceFlag{filepath.Join("testdata", "fixtures")}
+	if parameters.operation == "" {
+		parameters.operation = "CREATE"
+	}
+	if parameters.output == "" {
+		parameters.output = "patch"
+	}
+	if parameters.vpcprefix == "" {
+		parameters.vpcprefix = "k8s-poc"
+	}
+	parameters.locale = "en"
+	parameters.sdn = "yunshan"
+
+	var out bytes.Buffer
+	if err := simulate(parameters, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestSimulate(t *testing.T) {
+	out := simulateManifest(t, `
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: leo
+  labels:
+    kubesphere.io/workspace: leo-test
+`, simulateParameters{})
+	if !strings.Contains(out, "Allowed: true") || !strings.Contains(out, `"nci.yunshan.net/vpc":"k8s-poc-leo-test"`) {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+
+	out = simulateManifest(t, `
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: leo
+  labels:
+    kubesphere.io/workspace: missing
+`, simulateParameters{})
+	if !strings.Contains(out, "Allowed: false") || !strings.Contains(out, "Code:    404") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+
+	// 创建业务空间时输出创建vpc的副作用
+	out = simulateManifest(t, `
+apiVersion: tenant.kubesphere.io/v1alpha1
+kind: Workspace
+metadata:
+  name: new-team
+`, simulateParameters{})
+	if !strings.Contains(out, "Side effect: create vpcs k8s-poc-new-team") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+func TestSimulateObjectOutput(t *testing.T) {
+	out := simulateManifest(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: kubesphere-router-kube-system
+  namespace: kube-system
+  labels:
+    app.kubernetes.io/component: controller
+    app.kubernetes.io/name: ingress-nginx
+spec:
+  template:
+    metadata:
+      labels:
+        app: router
+`, simulateParameters{output: "object"})
+	if !strings.Contains(out, "nci.yunshan.net/ips: 10.64.88.1,") || !strings.Contains(out, "kind: Deployment") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+// 没有提供namespace的清单时，工作负载不会因为查询namespace失败被拒绝
+func TestSimulateWithoutNamespaceFixture(t *testing.T) {
+	out := simulateManifest(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: ingress
+  namespace: not-in-fixtures
+  labels:
+    app.kubernetes.io/component: controller
+    app.kubernetes.io/name: ingress-nginx
+`, simulateParameters{})
+	// 因为没有子网拒绝，不是查询namespace失败的503
+	if !strings.Contains(out, "Code:    404") || !strings.Contains(out, "not bound to any subnet") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
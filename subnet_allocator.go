@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// 每个vpc可以分配的网段，例如: k8s-poc-leo-test=10.64.0.0/16,*=10.96.0.0/12，"*"用于没有单独配置的vpc
+type supernets map[string]*net.IPNet
+
+func (s *supernets) String() string {
+	var pairs []string
+	for vpc, cidr := range *s {
+		pairs = append(pairs, vpc+"="+cidr.String())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (s *supernets) Set(value string) error {
+	nets := supernets{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair == "" {
+			continue
+		}
+		vpc, cidr, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid supernet %q, expect vpc=cidr", pair)
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid supernet of %s: %v", vpc, err)
+		}
+		nets[vpc] = ipNet
+	}
+	*s = nets
+	return nil
+}
+
+func (s supernets) forVpc(vpc string) *net.IPNet {
+	if ipNet, ok := s[vpc]; ok {
+		return ipNet
+	}
+	return s["*"]
+}
+
+func cidrsOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// 在supernet中按顺序找到第一个与used都不重叠、掩码长度为prefixLength的网段
+func carveSubnet(supernet *net.IPNet, prefixLength int, used []*net.IPNet) (*net.IPNet, error) {
+	ones, bits := supernet.Mask.Size()
+	if prefixLength < ones || prefixLength > bits {
+		return nil, fmt.Errorf("prefix length /%d does not fit in supernet %s", prefixLength, supernet)
+	}
+
+	mask := net.CIDRMask(prefixLength, bits)
+	step := new(big.Int).Lsh(big.NewInt(1), uint(bits-prefixLength))
+	count := new(big.Int).Lsh(big.NewInt(1), uint(prefixLength-ones))
+	ip := new(big.Int).SetBytes(supernet.IP)
+
+	for i := new(big.Int); i.Cmp(count) < 0; i.Add(i, big.NewInt(1)) {
+		candidate := &net.IPNet{IP: bigToIP(ip, len(supernet.IP)), Mask: mask}
+		free := true
+		for _, u := range used {
+			if cidrsOverlap(candidate, u) {
+				free = false
+				break
+			}
+		}
+		if free {
+			return candidate, nil
+		}
+		ip.Add(ip, step)
+	}
+	return nil, fmt.Errorf("supernet %s has no free /%d block", supernet, prefixLength)
+}
+
+func bigToIP(i *big.Int, size int) net.IP {
+	b := i.Bytes()
+	ip := make(net.IP, size)
+	copy(ip[size-len(b):], b)
+	return ip
+}
+
+// namespace分配到的网段，保存在ConfigMap中，key为namespace
+type subnetAllocation struct {
+	VPC  string `json:"vpc"`
+	CIDR string `json:"cidr"`
+}
+
+// 分配记录的ConfigMap，只由leader修改
+type allocationStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+// 读取分配记录，ConfigMap不存在时返回nil，保存时创建
+func (s allocationStore) load(ctx context.Context) (*corev1.ConfigMap, map[string]subnetAllocation, error) {
+	allocations := make(map[string]subnetAllocation)
+
+	cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, allocations, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for namespace, value := range cm.Data {
+		var allocation subnetAllocation
+		if err := json.Unmarshal([]byte(value), &allocation); err != nil {
+			return nil, nil, fmt.Errorf("allocation of %s: %v", namespace, err)
+		}
+		allocations[namespace] = allocation
+	}
+	return cm, allocations, nil
+}
+
+// 保存分配记录，通过resourceVersion避免覆盖其他写入
+func (s allocationStore) save(ctx context.Context, cm *corev1.ConfigMap, allocations map[string]subnetAllocation) error {
+	data := make(map[string]string, len(allocations))
+	for namespace, allocation := range allocations {
+		value, err := json.Marshal(allocation)
+		if err != nil {
+			return err
+		}
+		data[namespace] = string(value)
+	}
+
+	if cm == nil {
+		cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: s.name, Namespace: s.namespace}, Data: data}
+		_, err := s.client.CoreV1().ConfigMaps(s.namespace).Create(ctx, cm, metav1.CreateOptions{})
+		return err
+	}
+	cm = cm.DeepCopy()
+	cm.Data = data
+	_, err := s.client.CoreV1().ConfigMaps(s.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
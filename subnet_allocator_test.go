@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCarveSubnet(t *testing.T) {
+	mustCIDR := func(s string) *net.IPNet {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ipNet
+	}
+
+	cases := []struct {
+		name         string
+		supernet     string
+		prefixLength int
+		used         []string
+		want         string
+	}{
+		{name: "empty", supernet: "10.64.0.0/16", prefixLength: 24, want: "10.64.0.0/24"},
+		{name: "skip used", supernet: "10.64.0.0/16", prefixLength: 24, used: []string{"10.64.0.0/24", "10.64.1.0/24"}, want: "10.64.2.0/24"},
+		{name: "skip gap too small", supernet: "10.64.0.0/16", prefixLength: 23, used: []string{"10.64.1.0/24"}, want: "10.64.2.0/23"},
+		{name: "larger used block", supernet: "10.64.0.0/16", prefixLength: 24, used: []string{"10.64.0.0/20"}, want: "10.64.16.0/24"},
+		{name: "used outside", supernet: "10.64.0.0/16", prefixLength: 24, used: []string{"10.65.0.0/24"}, want: "10.64.0.0/24"},
+		{name: "whole supernet", supernet: "10.64.0.0/24", prefixLength: 24, want: "10.64.0.0/24"},
+		{name: "exhausted", supernet: "10.64.0.0/23", prefixLength: 24, used: []string{"10.64.0.0/24", "10.64.1.0/24"}},
+		{name: "too large", supernet: "10.64.0.0/24", prefixLength: 16},
+		{name: "ipv6", supernet: "fd00:10::/48", prefixLength: 64, used: []string{"fd00:10::/64"}, want: "fd00:10:0:1::/64"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var used []*net.IPNet
+			for _, u := range c.used {
+				used = append(used, mustCIDR(u))
+			}
+			got, err := carveSubnet(mustCIDR(c.supernet), c.prefixLength, used)
+			if c.want == "" {
+				if err == nil {
+					t.Errorf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != c.want {
+				t.Errorf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSupernetsFlag(t *testing.T) {
+	var s supernets
+	if err := s.Set("k8s-poc-a=10.64.0.0/16,*=10.96.0.0/12"); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.forVpc("k8s-poc-a").String(); got != "10.64.0.0/16" {
+		t.Errorf("got %s", got)
+	}
+	if got := s.forVpc("k8s-poc-b").String(); got != "10.96.0.0/12" {
+		t.Errorf("got %s", got)
+	}
+	if s.String() != "*=10.96.0.0/12,k8s-poc-a=10.64.0.0/16" {
+		t.Errorf("unexpected string %q", s.String())
+	}
+
+	for _, value := range []string{"k8s-poc-a", "k8s-poc-a=10.64.0.0"} {
+		if err := s.Set(value); err == nil {
+			t.Errorf("expected an error for %q", value)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// webhook自动创建的子网带有此label
+const subnetManagedByLabel = "admission-webhook-ks.cmft/managed-by"
+
+// 自动分配子网的参数
+type subnetParameters struct {
+	supernets    supernets
+	prefixLength int    // 每个namespace分配的网段掩码长度
+	configMap    string // 分配记录的ConfigMap，与Lease在同一个namespace
+	resync       time.Duration
+}
+
+// 为带有vpc label的namespace从vpc的supernet中划分网段并创建Subnet，只在leader上运行
+// namespace删除后回收分配的网段
+type subnetController struct {
+	client     Client
+	parameters subnetParameters
+	store      allocationStore
+	audit      *auditLogger
+	namespaces corelisters.NamespaceLister // 成为leader后从informer读取，之前为nil
+}
+
+func newSubnetController(client Client, parameters subnetParameters, namespace string, audit *auditLogger) *subnetController {
+	return &subnetController{
+		client:     client,
+		parameters: parameters,
+		store:      allocationStore{client: client.kubeClient, namespace: namespace, name: parameters.configMap},
+		audit:      audit,
+	}
+}
+
+// 每次成为leader时调用，失去leader后队列已经关闭，每个任期使用新的队列
+func (c *subnetController) run(ctx context.Context) {
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+
+	// informer在成为leader后才启动，非leader不监听namespace
+	factory := informers.NewSharedInformerFactory(c.client.kubeClient, c.parameters.resync)
+	informer := factory.Core().V1().Namespaces().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.enqueue(queue, obj) },
+		UpdateFunc: func(_, obj interface{}) { c.enqueue(queue, obj) },
+		DeleteFunc: func(obj interface{}) { c.enqueueDeleted(queue, obj) },
+	})
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return
+	}
+	c.namespaces = factory.Core().V1().Namespaces().Lister()
+
+	// 没有leader期间删除的namespace不会收到事件，启动时检查所有分配记录
+	if _, allocations, err := c.store.load(ctx); err != nil {
+		utilruntime.HandleError(fmt.Errorf("load subnet allocations: %v", err))
+	} else {
+		for name := range allocations {
+			queue.Add(name)
+		}
+	}
+
+	go wait.UntilWithContext(ctx, func(ctx context.Context) { c.worker(ctx, queue) }, time.Second)
+	<-ctx.Done()
+}
+
+func (c *subnetController) enqueue(queue workqueue.Interface, obj interface{}) {
+	if ns, ok := obj.(*corev1.Namespace); ok {
+		if vpc, _ := c.client.backend().namespaceVpc(ns); vpc != "" {
+			queue.Add(ns.Name)
+		}
+	}
+}
+
+func (c *subnetController) enqueueDeleted(queue workqueue.Interface, obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if ns, ok := obj.(*corev1.Namespace); ok {
+		queue.Add(ns.Name)
+	}
+}
+
+func (c *subnetController) worker(ctx context.Context, queue workqueue.RateLimitingInterface) {
+	for c.processNext(ctx, queue) {
+	}
+}
+
+func (c *subnetController) processNext(ctx context.Context, queue workqueue.RateLimitingInterface) bool {
+	key, quit := queue.Get()
+	if quit {
+		return false
+	}
+	defer queue.Done(key)
+
+	if err := c.reconcile(ctx, key.(string)); err != nil {
+		utilruntime.HandleError(fmt.Errorf("reconcile subnet of namespace %s: %v", key, err))
+		queue.AddRateLimited(key)
+		return true
+	}
+	queue.Forget(key)
+	return true
+}
+
+// 先写分配记录再创建Subnet，创建失败重试时沿用记录中的网段
+func (c *subnetController) reconcile(ctx context.Context, name string) error {
+	ns, err := c.client.kubeClient.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return c.release(ctx, name)
+	}
+	if err != nil {
+		return err
+	}
+	vpc, _ := c.client.backend().namespaceVpc(ns)
+	supernet := c.parameters.supernets.forVpc(vpc)
+	if vpc == "" || supernet == nil || ns.DeletionTimestamp != nil {
+		return nil
+	}
+
+	subnets, err := c.client.namespaceSubnets(ctx, name)
+	if err != nil {
+		return err
+	}
+	cm, allocations, err := c.store.load(ctx)
+	if err != nil {
+		return err
+	}
+
+	allocation, allocated := allocations[name]
+	if !allocated {
+		// 手工创建过子网的namespace不再分配
+		if len(subnets) > 0 {
+			return nil
+		}
+
+		used, err := c.usedCIDRs(ctx, vpc, allocations)
+		if err != nil {
+			return err
+		}
+		block, err := carveSubnet(supernet, c.parameters.prefixLength, used)
+		if err != nil {
+			return err
+		}
+
+		allocation = subnetAllocation{VPC: vpc, CIDR: block.String()}
+		allocations[name] = allocation
+		if err := c.store.save(ctx, cm, allocations); err != nil {
+			return err
+		}
+		glog.Infof("Allocated %s of vpc %s to namespace %s", allocation.CIDR, vpc, name)
+	} else if allocation.VPC != vpc {
+		glog.Warningf("Namespace %s moved from vpc %s to %s, keeping its subnet %s", name, allocation.VPC, vpc, allocation.CIDR)
+	}
+
+	if len(subnets) > 0 {
+		return nil
+	}
+	return c.createSubnet(ctx, name, allocation)
+}
+
+// namespace删除后从分配记录中移除网段，namespace中的Subnet随namespace一起被删除
+func (c *subnetController) release(ctx context.Context, name string) error {
+	cm, allocations, err := c.store.load(ctx)
+	if err != nil {
+		return err
+	}
+	allocation, ok := allocations[name]
+	if !ok {
+		return nil
+	}
+	if err := c.deleteClusterSubnet(ctx, name, allocation); err != nil {
+		return err
+	}
+
+	delete(allocations, name)
+	if err := c.store.save(ctx, cm, allocations); err != nil {
+		return err
+	}
+	glog.Infof("Released %s of vpc %s from deleted namespace %s", allocation.CIDR, allocation.VPC, name)
+	c.audit.record(auditEntry{
+		Action:    "release",
+		Resource:  "subnet",
+		Namespace: name,
+		VPC:       allocation.VPC,
+		CIDR:      allocation.CIDR,
+		Reason:    "namespace deleted",
+	})
+	return nil
+}
+
+// 集群级别的Subnet(Kube-OVN)不会随namespace删除，只删除webhook创建的
+func (c *subnetController) deleteClusterSubnet(ctx context.Context, namespace string, allocation subnetAllocation) error {
+	backend := c.client.backend()
+	provisioner, err := subnetProvisionerOf(backend)
+	if err != nil {
+		return err
+	}
+	subnet := provisioner.newSubnet(namespace, allocation.VPC, allocation.CIDR)
+	if subnet.GetNamespace() != "" {
+		return nil
+	}
+
+	resource := c.client.dynamicClient.Resource(backend.subnetResource())
+	existing, err := resource.Get(ctx, subnet.GetName(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if existing.GetLabels()[subnetManagedByLabel] == "" {
+		return nil
+	}
+	err = resource.Delete(ctx, subnet.GetName(), metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err == nil {
+		glog.Infof("Deleted subnet %s of deleted namespace %s", subnet.GetName(), namespace)
+	}
+	return err
+}
+
+// vpc中已经使用的网段: 分配记录以及同一vpc下其他namespace手工创建的子网
+func (c *subnetController) usedCIDRs(ctx context.Context, vpc string, allocations map[string]subnetAllocation) ([]*net.IPNet, error) {
+	var used []*net.IPNet
+	for _, allocation := range allocations {
+		if allocation.VPC != vpc {
+			continue
+		}
+		if _, ipNet, err := net.ParseCIDR(allocation.CIDR); err == nil {
+			used = append(used, ipNet)
+		}
+	}
+
+	backend := c.client.backend()
+	namespaces, err := c.listNamespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, ns := range namespaces {
+		if nsVpc, _ := backend.namespaceVpc(ns); nsVpc != vpc {
+			continue
+		}
+		subnets, err := c.client.namespaceSubnets(ctx, ns.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, subnet := range subnets {
+			if _, ipNet, err := net.ParseCIDR(subnet.CIDR); err == nil {
+				used = append(used, ipNet)
+			}
+		}
+	}
+	return used, nil
+}
+
+func (c *subnetController) listNamespaces(ctx context.Context) ([]*corev1.Namespace, error) {
+	if c.namespaces != nil {
+		return c.namespaces.List(labels.Everything())
+	}
+	list, err := c.client.kubeClient.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	namespaces := make([]*corev1.Namespace, 0, len(list.Items))
+	for i := range list.Items {
+		namespaces = append(namespaces, &list.Items[i])
+	}
+	return namespaces, nil
+}
+
+func (c *subnetController) createSubnet(ctx context.Context, namespace string, allocation subnetAllocation) error {
+	backend := c.client.backend()
+	provisioner, err := subnetProvisionerOf(backend)
+	if err != nil {
+		return err
+	}
+	subnet := provisioner.newSubnet(namespace, allocation.VPC, allocation.CIDR)
+	subnet.SetLabels(map[string]string{subnetManagedByLabel: "ks-webhook-controller"})
+
+	_, err = c.client.dynamicClient.Resource(backend.subnetResource()).Namespace(subnet.GetNamespace()).Create(ctx, subnet, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return nil
+	}
+	if err == nil {
+		glog.Infof("Created subnet %s of namespace %s with %s", subnet.GetName(), namespace, allocation.CIDR)
+	}
+	return err
+}
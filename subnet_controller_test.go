@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+const subnetFixtures = `
+apiVersion: nci.yunshan.net/v1
+kind: Subnet
+metadata:
+  name: manual-subnet
+  namespace: manual
+spec:
+  cidr: 10.64.0.0/24
+`
+
+func newTestSubnetController(t *testing.T) *subnetController {
+	t.Helper()
+
+	vpcNamespace := func(name, vpc string) runtime.Object {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if vpc != "" {
+			ns.Labels = map[string]string{admissionWebhookLabelsKey: vpc}
+		}
+		return ns
+	}
+	kubeClient := kubefake.NewSimpleClientset(
+		vpcNamespace("team-a", "k8s-poc-a"),
+		vpcNamespace("team-b", "k8s-poc-a"),
+		vpcNamespace("manual", "k8s-poc-a"),
+		vpcNamespace("other", "k8s-poc-b"),
+		vpcNamespace("plain", ""),
+	)
+
+	objects, err := decodeManifests([]byte(subnetFixtures))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dynamicClient, err := newFakeClient(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parameters subnetParameters
+	if err := parameters.supernets.Set("*=10.64.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	parameters.prefixLength = 24
+	parameters.configMap = "ks-webhook-subnet-allocations"
+
+	audit, err := newAuditLogger("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newSubnetController(Client{dynamicClient: dynamicClient, kubeClient: kubeClient}, parameters, "kube-system", audit)
+}
+
+func namespaceSubnets(t *testing.T, c *subnetController, namespace string) []string {
+	t.Helper()
+
+	list, err := c.client.dynamicClient.Resource(subnetGVR).Namespace(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cidrs []string
+	for _, item := range list.Items {
+		cidr, _, _ := unstructured.NestedString(item.Object, "spec", "cidr")
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs
+}
+
+func TestSubnetControllerCarvesBlocks(t *testing.T) {
+	c := newTestSubnetController(t)
+	ctx := context.TODO()
+
+	for _, ns := range []string{"team-a", "team-b", "manual", "other", "plain", "missing"} {
+		if err := c.reconcile(ctx, ns); err != nil {
+			t.Fatalf("reconcile %s: %v", ns, err)
+		}
+	}
+
+	want := map[string][]string{
+		"team-a": {"10.64.1.0/24"},
+		"team-b": {"10.64.2.0/24"},
+		"manual": {"10.64.0.0/24"},
+		// 不同vpc的网段可以重叠
+		"other": {"10.64.0.0/24"},
+		"plain": nil,
+	}
+	for ns, cidrs := range want {
+		got := namespaceSubnets(t, c, ns)
+		if len(got) != len(cidrs) || (len(got) > 0 && got[0] != cidrs[0]) {
+			t.Errorf("%s: got subnets %v, want %v", ns, got, cidrs)
+		}
+	}
+
+	_, allocations, err := c.store.load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocations) != 3 {
+		t.Errorf("unexpected allocations %v", allocations)
+	}
+	if _, ok := allocations["manual"]; ok {
+		t.Error("namespaces with a hand made subnet should not get an allocation")
+	}
+}
+
+func TestSubnetControllerUsesRecordedBlock(t *testing.T) {
+	c := newTestSubnetController(t)
+	ctx := context.TODO()
+
+	if err := c.reconcile(ctx, "team-a"); err != nil {
+		t.Fatal(err)
+	}
+	// Subnet被删除后按记录重新创建，网段不变
+	if err := c.client.dynamicClient.Resource(subnetGVR).Namespace("team-a").Delete(ctx, "team-a-subnet", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.reconcile(ctx, "team-b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.reconcile(ctx, "team-a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := namespaceSubnets(t, c, "team-a"); len(got) != 1 || got[0] != "10.64.1.0/24" {
+		t.Errorf("team-a: got %v", got)
+	}
+	if got := namespaceSubnets(t, c, "team-b"); len(got) != 1 || got[0] != "10.64.2.0/24" {
+		t.Errorf("team-b: got %v", got)
+	}
+}
+
+// 读取审计文件中的记录
+func readAudit(t *testing.T, path string) []auditEntry {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []auditEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry auditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestSubnetControllerReleasesDeletedNamespace(t *testing.T) {
+	c := newTestSubnetController(t)
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := newAuditLogger(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.audit = audit
+	ctx := context.TODO()
+
+	if err := c.reconcile(ctx, "team-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.client.kubeClient.CoreV1().Namespaces().Delete(ctx, "team-a", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.reconcile(ctx, "team-a"); err != nil {
+		t.Fatal(err)
+	}
+	// 重复处理不会产生新的记录
+	if err := c.reconcile(ctx, "team-a"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, allocations, err := c.store.load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := allocations["team-a"]; ok {
+		t.Error("allocation of the deleted namespace was not released")
+	}
+
+	entries := readAudit(t, auditPath)
+	if len(entries) != 1 {
+		t.Fatalf("got %d audit entries, want 1", len(entries))
+	}
+	if e := entries[0]; e.Action != "release" || e.Resource != "subnet" || e.Namespace != "team-a" || e.CIDR != "10.64.1.0/24" || e.VPC != "k8s-poc-a" {
+		t.Errorf("unexpected audit entry %+v", e)
+	}
+
+	// 回收的网段可以再次分配
+	if err := c.reconcile(ctx, "team-b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := namespaceSubnets(t, c, "team-b"); len(got) != 1 || got[0] != "10.64.1.0/24" {
+		t.Errorf("team-b: got %v", got)
+	}
+}
+
+// 失去leader后再次成为leader，新任期中创建的namespace同样分配子网
+func TestSubnetControllerRunsAgainAfterLosingLeadership(t *testing.T) {
+	c := newTestSubnetController(t)
+
+	for term := 1; term <= 2; term++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			c.run(ctx)
+		}()
+
+		name := fmt.Sprintf("term-%d", term)
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{admissionWebhookLabelsKey: "k8s-poc-a"}}}
+		if _, err := c.client.kubeClient.CoreV1().Namespaces().Create(ctx, ns, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		err := wait.PollUntilContextTimeout(ctx, 50*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+			return len(namespaceSubnets(t, c, name)) == 1, nil
+		})
+		cancel()
+		<-done
+		if err != nil {
+			t.Fatalf("term %d: namespace %s got no subnet", term, name)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// webhook监听端口的TLS策略
+type tlsParameters struct {
+	clientCA     string    // 校验客户端证书的CA，为空时不要求客户端证书
+	clientNames  sliceFlag // 允许的客户端证书CN或DNS名称，为空时接受clientCA签发的所有证书
+	minVersion   string    // 1.0、1.1、1.2或1.3
+	cipherSuites sliceFlag // TLS 1.2及以下使用的加密套件，为空时使用Go的默认值
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func newTLSConfig(parameters tlsParameters, certificates []tls.Certificate) (*tls.Config, error) {
+	minVersion, ok := tlsVersions[parameters.minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS version %q, expect 1.0, 1.1, 1.2 or 1.3", parameters.minVersion)
+	}
+	config := &tls.Config{
+		Certificates: certificates,
+		MinVersion:   minVersion,
+	}
+
+	// 只接受安全的套件，Go不允许配置TLS 1.3的套件，指定了也不会生效
+	if len(parameters.cipherSuites) > 0 {
+		if minVersion == tls.VersionTLS13 {
+			return nil, fmt.Errorf("cipher suites cannot be configured for TLS 1.3, remove them or lower the minimum version")
+		}
+		suites := make(map[string]*tls.CipherSuite)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite
+		}
+		for _, name := range parameters.cipherSuites {
+			suite, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("unsupported or insecure cipher suite %q", name)
+			}
+			if tls13Only(suite) {
+				return nil, fmt.Errorf("cipher suite %q is only used by TLS 1.3, which cannot be configured", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, suite.ID)
+		}
+	}
+
+	if parameters.clientCA != "" {
+		data, err := os.ReadFile(parameters.clientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", parameters.clientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		if len(parameters.clientNames) > 0 {
+			config.VerifyConnection = verifyClientName(parameters.clientNames)
+		}
+	} else if len(parameters.clientNames) > 0 {
+		return nil, fmt.Errorf("client names require a client CA")
+	}
+
+	return config, nil
+}
+
+func tls13Only(suite *tls.CipherSuite) bool {
+	for _, version := range suite.SupportedVersions {
+		if version != tls.VersionTLS13 {
+			return false
+		}
+	}
+	return true
+}
+
+// 客户端证书的CN或DNS名称必须在names中，例如只接受kube-apiserver的证书
+func verifyClientName(names sliceFlag) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("no client certificate")
+		}
+		cert := cs.PeerCertificates[0]
+		if names.has(cert.Subject.CommonName) {
+			return nil
+		}
+		for _, name := range cert.DNSNames {
+			if names.has(name) {
+				return nil
+			}
+		}
+		return fmt.Errorf("client certificate %q is not allowed", cert.Subject.CommonName)
+	}
+}
+
+// net/http的错误日志写入glog，握手失败会记录为"http: TLS handshake error from ..."
+type serverErrorWriter struct{}
+
+func (serverErrorWriter) Write(p []byte) (int, error) {
+	glog.Warning(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+func serverErrorLog() *log.Logger {
+	return log.New(serverErrorWriter{}, "", 0)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// 签发测试用的证书，parent为nil时自签名
+func issueCert(t *testing.T, name string, parent *testCert, isCA bool) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:         isCA,
+
+		BasicConstraintsValid: true,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	config, err := newTLSConfig(tlsParameters{minVersion: "1.2", cipherSuites: sliceFlag{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MinVersion != tls.VersionTLS12 || len(config.CipherSuites) != 1 || config.ClientAuth != tls.NoClientCert {
+		t.Errorf("unexpected config %+v", config)
+	}
+
+	for _, parameters := range []tlsParameters{
+		{minVersion: "1.4"},
+		{minVersion: "1.2", cipherSuites: sliceFlag{"TLS_RSA_WITH_RC4_128_SHA"}},
+		// TLS 1.3的套件不能配置
+		{minVersion: "1.2", cipherSuites: sliceFlag{"TLS_AES_128_GCM_SHA256"}},
+		{minVersion: "1.3", cipherSuites: sliceFlag{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}},
+		{minVersion: "1.2", clientNames: sliceFlag{"kube-apiserver"}},
+		{minVersion: "1.2", clientCA: filepath.Join(t.TempDir(), "missing.crt")},
+	} {
+		if _, err := newTLSConfig(parameters, nil); err == nil {
+			t.Errorf("expected an error for %+v", parameters)
+		}
+	}
+}
+
+// 只接受clientCA签发且名称在-tls-client-names中的客户端证书
+func TestMutualTLS(t *testing.T) {
+	ca := issueCert(t, "webhook-ca", nil, true)
+	serverCert := issueCert(t, "ks-webhook-controller", ca, false)
+	apiserver := issueCert(t, "kube-apiserver", ca, false)
+	other := issueCert(t, "someone", ca, false)
+	stranger := issueCert(t, "kube-apiserver", issueCert(t, "other-ca", nil, true), false)
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := newTLSConfig(tlsParameters{clientCA: caFile, clientNames: sliceFlag{"kube-apiserver"}, minVersion: "1.2"}, []tls.Certificate{serverCert.tlsCertificate()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := func(config *tls.Config) *httptest.Server {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.TLS = config
+		server.Config.ErrorLog = serverErrorLog()
+		server.StartTLS()
+		t.Cleanup(server.Close)
+		return server
+	}
+	server := start(config)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(server *httptest.Server, client *testCert, maxVersion uint16) error {
+		clientConfig := &tls.Config{RootCAs: roots, MaxVersion: maxVersion}
+		if client != nil {
+			clientConfig.Certificates = []tls.Certificate{client.tlsCertificate()}
+		}
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		resp, err := c.Get(server.URL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if err := get(server, apiserver, 0); err != nil {
+		t.Errorf("kube-apiserver rejected: %v", err)
+	}
+	for name, client := range map[string]*testCert{"no certificate": nil, "other name": other, "other ca": stranger} {
+		if err := get(server, client, 0); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+
+	// 低于最低版本的握手被拒绝
+	config = config.Clone()
+	config.MinVersion = tls.VersionTLS13
+	if err := get(start(config), apiserver, tls.VersionTLS12); err == nil {
+		t.Error("TLS 1.2 accepted with -tls-min-version 1.3")
+	}
+}
@@ -1,15 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	v1 "k8s.io/api/admission/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 )
 
 var (
@@ -35,17 +38,51 @@ type WebhookServer struct {
 	vpcprefix  string
 	abnormalws sliceFlag
 	cluster    string
+	locale     locale
+	features   sliceFlag
+	client     Client
+	// 单个请求的处理时限，调用apiserver和sdn接口都受此限制
+	timeout      time.Duration
+	failureModes failureModes
+	vpcTemplates []vpcTemplate
+	// 启用的处理器，为空时启用所有功能开启的处理器
+	handlers sliceFlag
+	// 没有处理器的资源放行还是拒绝
+	unregisteredKinds failureMode
+	// 并发和速率限制，为nil时不限制
+	limiter *admissionLimiter
+	// 允许namespace指定vpc的管理员组和vpc
+	vpcOverride vpcOverridePolicy
 }
 
 // Webhook Server parameters
 type WhSvrParameters struct {
-	port           int       // webhook server port
-	certFile       string    // path to the x509 certificate for https
-	keyFile        string    // path to the x509 private key matching `CertFile`
-	sidecarCfgFile string    // path to sidecar injector configuration file
-	vpcprefix      string    // vpc label key prefix
-	workspaces     sliceFlag // abnormal workspaces
-	cluster        string    //cluster name
+	port           int           // webhook server port
+	metricsPort    int           // plain http port of /debug/vars and /report, 0 disables it
+	certFile       string        // path to the x509 certificate for https
+	keyFile        string        // path to the x509 private key matching `CertFile`
+	tls            tlsParameters // TLS policy of the listener
+	sidecarCfgFile string        // path to sidecar injector configuration file
+	vpcprefix      string        // vpc label key prefix
+	workspaces     sliceFlag     // abnormal workspaces
+	cluster        string        //cluster name
+	locale         string        // default locale of user-facing messages
+	kubeconfig     string        // path to kubeconfig, empty for in-cluster config
+	features       sliceFlag     // enabled features
+	leaderElection leaderElectionParameters
+	timeout        time.Duration // webhook timeout, bounds every request
+	failureModes   failureModes  // per kind behavior when dependencies are unavailable
+	vpcTemplates   string        // path to the vpc template file
+	sdn            string        // sdn backing vpcs and subnets
+	subnets        subnetParameters
+	auditLog       string    // path to the audit log of released network resources
+	reportEndpoint bool      // serve the drift report on /report of metricsPort
+	handlers       sliceFlag // enabled handlers by resource, empty enables all
+	unregistered   string    // allow or deny requests no handler is registered for
+	maxInflight    int       // admission requests handled at the same time, 0 for no limit
+	qps            float64   // admission requests accepted per second, 0 for no limit
+	burst          int       // admission requests accepted in a burst above qps
+	vpcOverride    vpcOverridePolicy
 }
 
 type patchOperation struct {
@@ -55,11 +92,17 @@ type patchOperation struct {
 }
 
 type serverMate struct {
-	vpcprefix  string
-	cluster    string
-	abnormalws sliceFlag
-	op         v1.Operation
-	client     Client
+	ctx          context.Context
+	vpcprefix    string
+	cluster      string
+	abnormalws   sliceFlag
+	op           v1.Operation
+	kind         string // 请求的资源类型
+	dryRun       bool
+	locale       locale
+	client       Client
+	vpcTemplates []vpcTemplate
+	vpcOverride  vpcOverridePolicy
 }
 
 type Nets struct {
@@ -108,6 +151,19 @@ func (f *sliceFlag) Set(value string) error {
 	return nil
 }
 
+func (f sliceFlag) has(value string) bool {
+	for _, v := range f {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 type Client struct {
-	dynamicClient *dynamic.DynamicClient
+	dynamicClient dynamic.Interface
+	kubeClient    kubernetes.Interface
+	sdn           sdnBackend
+	// 处理请求时读取的WebhookPolicy和namespace缓存，为nil时直接查询apiserver
+	cache *policyCache
 }
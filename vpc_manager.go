@@ -2,17 +2,18 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"time"
 
 	"github.com/golang/glog"
 	v1 "k8s.io/api/admission/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
-func vpcHandler(wsName string, svmate serverMate) *v1.AdmissionResponse {
+func vpcHandler(wsName string, workspace *unstructured.Unstructured, svmate serverMate) *v1.AdmissionResponse {
 
 	//vpcName := "k8s-xpq-csy-poc-test"
 
@@ -31,110 +32,157 @@ func vpcHandler(wsName string, svmate serverMate) *v1.AdmissionResponse {
 		vpcName = generateVpcName(wsName, svmate)
 	}
 
-	switch svmate.op {
-	case "DELETE":
-		//workspace删除时同步删除vpc
-		if !client.chekVpc(vpcName) || client.delVpc(vpcName) {
-			return &v1.AdmissionResponse{
-				Allowed: true,
-			}
-		}
-	case "CREATE":
-		//workspace创建时同步创建vpc
-		if client.chekVpc(vpcName) || client.createVpc(vpcName, label) {
-			return &v1.AdmissionResponse{
-				Allowed: true,
-			}
-		}
-	default:
-		// 其他操作
+	//按WebhookPolicy判断是否同步管理vpc
+	enabled, err := client.featureEnabled(svmate.ctx, featureVpcLifecycle, policySubject{
+		workspace:    wsName,
+		objectLabels: workspace.GetLabels(),
+	})
+	if err != nil {
+		return denied(svmate.locale, transientError(err, msgPolicyLookupFailed))
+	}
+	if !enabled {
+		glog.Infof("业务空间%s的vpc管理功能被WebhookPolicy关闭", wsName)
 		return &v1.AdmissionResponse{
 			Allowed: true,
 		}
 	}
 
-	msg := fmt.Sprintf("Vpc %s %s failed", vpcName, svmate.op)
-	glog.Errorf(msg)
-	return &v1.AdmissionResponse{
-		Result: &metav1.Status{
-			Message: msg,
-		},
+	//dryRun的请求不能创建或删除vpc
+	if svmate.dryRun {
+		glog.Infof("Skipping vpc %s for dry run request", vpcName)
+		return &v1.AdmissionResponse{
+			Allowed: true,
+		}
 	}
-}
-
-func (c *Client) chekVpc(vpcName string) bool {
 
-	// 设置要请求的 GVR
-	gvr := schema.GroupVersionResource{
-		Group:    "nci.yunshan.net",
-		Version:  "v1",
-		Resource: "vpcs",
+	switch svmate.op {
+	case "DELETE":
+		//workspace删除时同步删除vpc
+		err = client.delVpc(svmate.ctx, vpcName)
+	case "CREATE":
+		//workspace创建时同步创建vpc，按模板设置spec
+		var vpc *unstructured.Unstructured
+		vpc, err = renderVpc(client.backend(), svmate.vpcTemplates, vpcTemplateData{
+			Name:        vpcName,
+			Workspace:   wsName,
+			Cluster:     svmate.cluster,
+			Labels:      workspace.GetLabels(),
+			Annotations: workspace.GetAnnotations(),
+		}, label)
+		if err != nil {
+			return denied(svmate.locale, internalError(err, msgVpcTemplateFailed, vpcName))
+		}
+		if field := missingVpcField(client.backend(), vpc); field != "" {
+			return denied(svmate.locale, policyViolation(msgVpcFieldMissing, vpcName, field))
+		}
+		err = client.ensureVpc(svmate.ctx, vpc)
 	}
-
-	// 发送请求，并得到返回结果
-	unStructData, err := c.dynamicClient.Resource(gvr).Get(context.TODO(), vpcName, metav1.GetOptions{})
 	if err != nil {
-		glog.Error(err.Error())
-		return false
+		return denied(svmate.locale, vpcError(err, vpcName, svmate.op))
 	}
 
-	var obj Vpc
-
-	// 使用 runtime.DefaultUnstructuredConverter 转换 item 为对象
-	err = runtime.DefaultUnstructuredConverter.FromUnstructured(unStructData.UnstructuredContent(), &obj)
-	if err != nil {
-		glog.Error(err.Error())
-		//return false
-
+	return &v1.AdmissionResponse{
+		Allowed: true,
 	}
+}
 
-	return true
+// 冲突和限流的重试间隔，总时长同时受请求的deadline限制
+var vpcBackoff = wait.Backoff{
+	Steps:    5,
+	Duration: 100 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+	Cap:      2 * time.Second,
 }
 
-func (c *Client) createVpc(vpcName string, label map[string]string) bool {
+// 冲突、限流和apiserver超时可以重试
+func retriableVpcError(err error) bool {
+	return apierrors.IsConflict(err) || apierrors.IsTooManyRequests(err) || apierrors.IsServerTimeout(err)
+}
 
-	// 设置要请求的 GVR
-	gvr := schema.GroupVersionResource{
-		Group:    "nci.yunshan.net",
-		Version:  "v1",
-		Resource: "vpcs",
+// 按vpcBackoff重试可重试的错误，放弃时返回最后一次的错误
+func retryVpcOperation(ctx context.Context, op func() error) error {
+	var lastErr error
+	err := wait.ExponentialBackoffWithContext(ctx, vpcBackoff, func(ctx context.Context) (bool, error) {
+		lastErr = op()
+		if lastErr == nil {
+			return true, nil
+		}
+		if retriableVpcError(lastErr) {
+			glog.Warningf("Retrying vpc operation: %v", lastErr)
+			return false, nil
+		}
+		return false, lastErr
+	})
+	if wait.Interrupted(err) && lastErr != nil {
+		return lastErr
 	}
+	return err
+}
 
-	vpc := &unstructured.Unstructured{
-		Object: map[string]interface{}{
-			"apiVersion": "nci.yunshan.net/v1",
-			"kind":       "VPC",
-			"metadata": map[string]interface{}{
-				"name":   vpcName,
-				"labels": label,
-			},
-		},
+// vpc操作失败的原因，apiserver或sdn暂时不可用的按临时错误处理，其他错误(权限、校验等)按内部错误返回
+func vpcError(err error, vpcName string, op v1.Operation) *admissionError {
+	if retriableVpcError(err) || apierrors.IsServiceUnavailable(err) || apierrors.IsInternalError(err) ||
+		apierrors.IsTimeout(err) || errors.Is(err, context.DeadlineExceeded) || !isAPIStatus(err) {
+		return transientError(err, msgVpcOperationFailed, vpcName, op)
 	}
+	return internalError(err, msgVpcOperationFailed, vpcName, op)
+}
 
-	// 发送请求，并得到返回结果
-	unStructData, err := c.dynamicClient.Resource(gvr).Create(context.TODO(), vpc, metav1.CreateOptions{})
-	if err != nil {
-		glog.Error(err.Error())
-		return false
-	}
-	glog.Info("%v", unStructData)
-	return true
+func isAPIStatus(err error) bool {
+	var status apierrors.APIStatus
+	return errors.As(err, &status)
 }
 
-func (c *Client) delVpc(vpcName string) bool {
+func (c *Client) chekVpc(ctx context.Context, vpcName string) (bool, error) {
+	var exist bool
+	err := retryVpcOperation(ctx, func() error {
+		_, err := c.dynamicClient.Resource(c.backend().vpcResource()).Get(ctx, vpcName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			exist = false
+			return nil
+		}
+		exist = err == nil
+		return err
+	})
+	return exist, err
+}
 
-	// 设置要请求的 GVR
-	gvr := schema.GroupVersionResource{
-		Group:    "nci.yunshan.net",
-		Version:  "v1",
-		Resource: "vpcs",
+// vpc不存在时创建，并发创建返回AlreadyExists也视为成功
+func (c *Client) ensureVpc(ctx context.Context, vpc *unstructured.Unstructured) error {
+	exist, err := c.chekVpc(ctx, vpc.GetName())
+	if err != nil || exist {
+		return err
 	}
+	return c.createVpc(ctx, vpc)
+}
 
-	// 发送请求，并得到返回结果
-	err := c.dynamicClient.Resource(gvr).Delete(context.TODO(), vpcName, metav1.DeleteOptions{})
-	if err != nil {
-		glog.Error(err.Error())
-		return false
-	}
-	return true
+func (c *Client) createVpc(ctx context.Context, vpc *unstructured.Unstructured) error {
+	vpcName := vpc.GetName()
+	return retryVpcOperation(ctx, func() error {
+		_, err := c.dynamicClient.Resource(c.backend().vpcResource()).Create(ctx, vpc, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			glog.Infof("vpc %s already exists", vpcName)
+			return nil
+		}
+		if err == nil {
+			glog.Infof("Created vpc %s", vpcName)
+		}
+		return err
+	})
+}
+
+// 删除vpc，已经不存在的视为成功
+func (c *Client) delVpc(ctx context.Context, vpcName string) error {
+	return retryVpcOperation(ctx, func() error {
+		err := c.dynamicClient.Resource(c.backend().vpcResource()).Delete(ctx, vpcName, metav1.DeleteOptions{})
+		if apierrors.IsNotFound(err) {
+			glog.Infof("vpc %s already deleted", vpcName)
+			return nil
+		}
+		if err == nil {
+			glog.Infof("Deleted vpc %s", vpcName)
+		}
+		return err
+	})
 }
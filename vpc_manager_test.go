@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestVpcOperationErrors(t *testing.T) {
+	vpcResource := schema.GroupResource{Group: vpcGVR.Group, Resource: vpcGVR.Resource}
+
+	cases := []struct {
+		name    string
+		request string
+		verb    string
+		// 依次返回的错误，用完后交给默认的处理
+		errs    []error
+		allowed bool
+		code    int32
+		calls   int
+	}{
+		{
+			name:    "create already exists",
+			request: "workspace-create",
+			verb:    "create",
+			errs:    []error{apierrors.NewAlreadyExists(vpcResource, "k8s-poc-leo-test")},
+			allowed: true,
+			calls:   1,
+		},
+		{
+			name:    "create conflict retried",
+			request: "workspace-create",
+			verb:    "create",
+			errs:    []error{apierrors.NewConflict(vpcResource, "k8s-poc-leo-test", nil), apierrors.NewTooManyRequests("slow down", 0)},
+			allowed: true,
+			calls:   3,
+		},
+		{
+			name:    "create forbidden",
+			request: "workspace-create",
+			verb:    "create",
+			errs:    []error{apierrors.NewForbidden(vpcResource, "k8s-poc-leo-test", nil)},
+			code:    500,
+			calls:   1,
+		},
+		{
+			name:    "create keeps conflicting",
+			request: "workspace-create",
+			verb:    "create",
+			errs: []error{
+				apierrors.NewConflict(vpcResource, "k8s-poc-leo-test", nil),
+				apierrors.NewConflict(vpcResource, "k8s-poc-leo-test", nil),
+				apierrors.NewConflict(vpcResource, "k8s-poc-leo-test", nil),
+				apierrors.NewConflict(vpcResource, "k8s-poc-leo-test", nil),
+				apierrors.NewConflict(vpcResource, "k8s-poc-leo-test", nil),
+			},
+			code:  503,
+			calls: 5,
+		},
+		{
+			name:    "delete not found",
+			request: "workspace-delete",
+			verb:    "delete",
+			errs:    []error{apierrors.NewNotFound(vpcResource, "k8s-poc-shanglv")},
+			allowed: true,
+			calls:   1,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			whsvr, fakeClient := newTestServer(t, "k8s-poc")
+
+			calls := 0
+			fakeClient.PrependReactor(c.verb, "vpcs", func(action clienttesting.Action) (bool, runtime.Object, error) {
+				calls++
+				if calls <= len(c.errs) {
+					return true, nil, c.errs[calls-1]
+				}
+				return false, nil, nil
+			})
+
+			body, err := os.ReadFile(filepath.Join("testdata", "requests", c.request+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := toGolden(t, admit(t, whsvr, body), nil)
+			if got.Allowed != c.allowed || got.Code != c.code {
+				t.Errorf("got allowed=%v code=%d (%s), want allowed=%v code=%d", got.Allowed, got.Code, got.Message, c.allowed, c.code)
+			}
+			if calls != c.calls {
+				t.Errorf("got %d %s calls, want %d", calls, c.verb, c.calls)
+			}
+		})
+	}
+}
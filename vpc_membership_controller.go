@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// 按namespace记录的vpc维护vpc登记的namespace，只在leader上运行
+// 注入时已经登记过，这里处理namespace的删除、改绑、先于vpc创建的namespace以及webhook没有处理的namespace
+type vpcMembershipController struct {
+	client     Client
+	membership vpcMembership
+	resync     time.Duration
+
+	namespaces corelisters.NamespaceLister
+	vpcs       cache.GenericLister
+}
+
+// 每次成为leader时调用，每个任期使用新的队列
+func (c *vpcMembershipController) run(ctx context.Context) {
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+
+	factory := informers.NewSharedInformerFactory(c.client.kubeClient, c.resync)
+	nsInformer := factory.Core().V1().Namespaces()
+	nsInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.enqueueNamespace(queue, obj) },
+		UpdateFunc: func(_, obj interface{}) { c.enqueueNamespace(queue, obj) },
+		DeleteFunc: func(obj interface{}) { c.enqueueNamespace(queue, obj) },
+	})
+	vpcFactory := dynamicinformer.NewDynamicSharedInformerFactory(c.client.dynamicClient, c.resync)
+	vpcInformer := vpcFactory.ForResource(c.client.backend().vpcResource())
+	vpcInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.enqueueVpc(queue, obj) },
+		UpdateFunc: func(_, obj interface{}) { c.enqueueVpc(queue, obj) },
+	})
+	c.namespaces, c.vpcs = nsInformer.Lister(), vpcInformer.Lister()
+
+	factory.Start(ctx.Done())
+	vpcFactory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), nsInformer.Informer().HasSynced, vpcInformer.Informer().HasSynced) {
+		return
+	}
+
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		for c.processNext(ctx, queue) {
+		}
+	}, time.Second)
+	<-ctx.Done()
+}
+
+func (c *vpcMembershipController) enqueueNamespace(queue workqueue.Interface, obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if ns, ok := obj.(*corev1.Namespace); ok {
+		queue.Add(ns.Name)
+	}
+}
+
+// vpc变化时检查登记的namespace以及记录为该vpc的namespace
+func (c *vpcMembershipController) enqueueVpc(queue workqueue.Interface, obj interface{}) {
+	vpc, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	for _, member := range c.membership.vpcMembers(vpc) {
+		queue.Add(member)
+	}
+	namespaces, err := c.namespaces.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	for _, ns := range namespaces {
+		if nsVpc, _ := c.client.backend().namespaceVpc(ns); nsVpc == vpc.GetName() {
+			queue.Add(ns.Name)
+		}
+	}
+}
+
+func (c *vpcMembershipController) processNext(ctx context.Context, queue workqueue.RateLimitingInterface) bool {
+	key, quit := queue.Get()
+	if quit {
+		return false
+	}
+	defer queue.Done(key)
+
+	if err := c.reconcile(ctx, key.(string)); err != nil {
+		utilruntime.HandleError(fmt.Errorf("reconcile vpc membership of namespace %s: %v", key, err))
+		queue.AddRateLimited(key)
+		return true
+	}
+	queue.Forget(key)
+	return true
+}
+
+// namespace只登记在记录的vpc上，删除的namespace从所有vpc上移除
+func (c *vpcMembershipController) reconcile(ctx context.Context, name string) error {
+	var expected string
+	ns, err := c.namespaces.Get(name)
+	switch {
+	case apierrors.IsNotFound(err):
+	case err != nil:
+		return err
+	case ns.DeletionTimestamp == nil:
+		expected, _ = c.client.backend().namespaceVpc(ns)
+	}
+
+	vpcs, err := c.vpcs.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, obj := range vpcs {
+		vpc, ok := obj.(*unstructured.Unstructured)
+		if !ok || !managedVpc(vpc) {
+			continue
+		}
+		member := sliceFlag(c.membership.vpcMembers(vpc)).has(name)
+		switch {
+		case vpc.GetName() == expected && !member:
+			if err := c.membership.joinVpc(ctx, c.client.dynamicClient, vpc.GetName(), name); err != nil {
+				return err
+			}
+			glog.Infof("Added namespace %s to vpc %s", name, vpc.GetName())
+		case vpc.GetName() != expected && member:
+			if err := c.membership.leaveVpc(ctx, c.client.dynamicClient, vpc.GetName(), name); err != nil {
+				return err
+			}
+			glog.Infof("Removed namespace %s from vpc %s", name, vpc.GetName())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// team-a改绑到vpc-a，team-b已经删除，ovn-cluster不是webhook创建的vpc
+const membershipVpcs = `
+apiVersion: kubeovn.io/v1
+kind: Vpc
+metadata:
+  name: vpc-a
+  labels:
+    kubesphere.io/workspace: a
+spec:
+  namespaces:
+  - team-b
+---
+apiVersion: kubeovn.io/v1
+kind: Vpc
+metadata:
+  name: vpc-b
+  labels:
+    kubesphere.io/workspace: b
+spec:
+  namespaces:
+  - team-a
+  - team-c
+---
+apiVersion: kubeovn.io/v1
+kind: Vpc
+metadata:
+  name: ovn-cluster
+spec:
+  namespaces:
+  - team-a
+`
+
+func TestVpcMembershipController(t *testing.T) {
+	objects, err := decodeManifests([]byte(membershipVpcs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dynamicClient, err := newFakeClient(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vpcIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, obj := range objects {
+		if err := vpcIndexer.Add(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nsIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, ns := range []*corev1.Namespace{
+		{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{kubeOVNVpcLabel: "vpc-a"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "team-c", Labels: map[string]string{kubeOVNVpcLabel: "vpc-b"}}},
+	} {
+		if err := nsIndexer.Add(ns); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &vpcMembershipController{
+		client:     Client{dynamicClient: dynamicClient, sdn: kubeOVNBackend{}},
+		membership: kubeOVNBackend{},
+		namespaces: corelisters.NewNamespaceLister(nsIndexer),
+		vpcs:       cache.NewGenericLister(vpcIndexer, kubeOVNVpcGVR.GroupResource()),
+	}
+	ctx := context.Background()
+	for _, name := range []string{"team-a", "team-b", "team-c"} {
+		if err := c.reconcile(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string][]string{
+		"vpc-a":       {"team-a"},
+		"vpc-b":       {"team-c"},
+		"ovn-cluster": {"team-a"},
+	}
+	for name, members := range want {
+		vpc, err := dynamicClient.Resource(kubeOVNVpcGVR).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := (kubeOVNBackend{}).vpcMembers(vpc); !reflect.DeepEqual(got, members) {
+			t.Errorf("namespaces of %s: %v, want %v", name, got, members)
+		}
+	}
+}
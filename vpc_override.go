@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// namespace上指定vpc的annotation，代替业务空间默认的vpc
+const vpcOverrideAnnotation = "admission-webhook-ks.cmft/vpc-override"
+
+// 谁可以指定vpc，以及可以指定哪些vpc，两者为空时不允许指定
+type vpcOverridePolicy struct {
+	adminGroups sliceFlag
+	vpcs        sliceFlag
+}
+
+// namespace指定的vpc，没有指定时返回false
+func vpcOverride(meta *metav1.ObjectMeta) (string, bool) {
+	vpc := meta.Annotations[vpcOverrideAnnotation]
+	return vpc, vpc != ""
+}
+
+// 检查请求能否指定vpc：vpc必须在允许的列表中，请求者必须属于管理员组
+// 更新时annotation没有变化的，说明创建时已经检查过，不再要求管理员组
+func (p vpcOverridePolicy) authorize(req *v1.AdmissionRequest, namespace *corev1.Namespace) error {
+	vpc, ok := vpcOverride(&namespace.ObjectMeta)
+	if !ok {
+		return nil
+	}
+	if !p.vpcs.has(vpc) {
+		return policyViolation(msgVpcOverrideNotAllowed, vpc, namespace.Name)
+	}
+	if p.isAdmin(req.UserInfo.Groups) || unchangedOverride(req, vpc) {
+		glog.Infof("%s使用指定的vpc %s，请求者: %s", namespace.Name, vpc, req.UserInfo.Username)
+		return nil
+	}
+	return policyViolation(msgVpcOverrideForbidden, req.UserInfo.Username, namespace.Name)
+}
+
+// 非管理员只能把namespace绑定到expected(webhook计算出的vpc)或者更新前绑定的vpc
+// 关闭了修改或者被WebhookPolicy排除的namespace不会被覆盖绑定，同样需要检查
+func (p vpcOverridePolicy) authorizeBinding(req *v1.AdmissionRequest, namespace *corev1.Namespace, backend sdnBackend, expected string) error {
+	vpc, ok := backend.namespaceVpc(namespace)
+	if !ok || vpc == "" || vpc == expected || p.isAdmin(req.UserInfo.Groups) {
+		return nil
+	}
+	if req.Operation == v1.Update && len(req.OldObject.Raw) > 0 {
+		var old corev1.Namespace
+		if err := json.Unmarshal(req.OldObject.Raw, &old); err == nil {
+			if oldVpc, _ := backend.namespaceVpc(&old); oldVpc == vpc {
+				return nil
+			}
+		}
+	}
+	return policyViolation(msgVpcBindingForbidden, req.UserInfo.Username, namespace.Name, vpc)
+}
+
+func (p vpcOverridePolicy) isAdmin(groups []string) bool {
+	for _, group := range groups {
+		if p.adminGroups.has(group) {
+			return true
+		}
+	}
+	return false
+}
+
+func unchangedOverride(req *v1.AdmissionRequest, vpc string) bool {
+	if req.Operation != v1.Update || len(req.OldObject.Raw) == 0 {
+		return false
+	}
+	var old corev1.Namespace
+	if err := json.Unmarshal(req.OldObject.Raw, &old); err != nil {
+		return false
+	}
+	oldVpc, ok := vpcOverride(&old.ObjectMeta)
+	return ok && oldVpc == vpc
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// vpc模板配置文件，按顺序匹配业务空间，第一个匹配的模板生效，都不匹配时使用sdn的默认值
+//
+//	templates:
+//	- name: finance
+//	  workspaces: [finance, finance-dr]
+//	  template: |
+//	    spec:
+//	      cidr: 10.20.0.0/16
+type vpcTemplateConfig struct {
+	Templates []vpcTemplate `json:"templates"`
+}
+
+type vpcTemplate struct {
+	Name string `json:"name"`
+	// 业务空间名称
+	Workspaces []string `json:"workspaces,omitempty"`
+	// 业务空间的label
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+	// 业务空间必须带有的annotation
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// text/template格式的VPC对象片段，可以包含metadata.labels、metadata.annotations和spec
+	Template string `json:"template"`
+
+	parsed   *template.Template
+	selector labels.Selector
+}
+
+// 渲染模板时可以使用的字段
+type vpcTemplateData struct {
+	Name        string // vpc名称
+	Workspace   string
+	Cluster     string
+	Labels      map[string]string // 业务空间的label
+	Annotations map[string]string // 业务空间的annotation
+}
+
+func loadVpcTemplates(path string) ([]vpcTemplate, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config vpcTemplateConfig
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	for i := range config.Templates {
+		t := &config.Templates[i]
+		if t.Name == "" {
+			return nil, fmt.Errorf("%s: template %d has no name", path, i)
+		}
+		if t.parsed, err = template.New(t.Name).Option("missingkey=zero").Parse(t.Template); err != nil {
+			return nil, fmt.Errorf("%s: template %s: %v", path, t.Name, err)
+		}
+		if t.Selector != nil {
+			if t.selector, err = metav1.LabelSelectorAsSelector(t.Selector); err != nil {
+				return nil, fmt.Errorf("%s: template %s: %v", path, t.Name, err)
+			}
+		}
+	}
+	return config.Templates, nil
+}
+
+// 名称、label和annotation都满足时匹配，没有设置的条件不参与判断
+func (t *vpcTemplate) matches(data vpcTemplateData) bool {
+	if len(t.Workspaces) > 0 && !sliceFlag(t.Workspaces).has(data.Workspace) {
+		return false
+	}
+	if t.selector != nil && !t.selector.Matches(labels.Set(data.Labels)) {
+		return false
+	}
+	for k, v := range t.Annotations {
+		if value, ok := data.Annotations[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+func selectVpcTemplate(templates []vpcTemplate, data vpcTemplateData) *vpcTemplate {
+	for i := range templates {
+		if templates[i].matches(data) {
+			return &templates[i]
+		}
+	}
+	return nil
+}
+
+// 模板渲染后的内容，只允许设置label、annotation和spec
+type vpcFragment struct {
+	Metadata struct {
+		Labels      map[string]string `json:"labels,omitempty"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+	} `json:"metadata,omitempty"`
+	Spec map[string]interface{} `json:"spec,omitempty"`
+}
+
+// 生成要创建的VPC对象，集群和业务空间的label不能被模板覆盖
+func renderVpc(backend sdnBackend, templates []vpcTemplate, data vpcTemplateData, label map[string]string) (*unstructured.Unstructured, error) {
+	vpc := backend.newVpc(data.Name)
+
+	vpcLabels := make(map[string]string)
+	if t := selectVpcTemplate(templates, data); t != nil {
+		var out bytes.Buffer
+		if err := t.parsed.Execute(&out, data); err != nil {
+			return nil, fmt.Errorf("template %s: %v", t.Name, err)
+		}
+		var fragment vpcFragment
+		if err := yaml.UnmarshalStrict(out.Bytes(), &fragment); err != nil {
+			return nil, fmt.Errorf("template %s: %v", t.Name, err)
+		}
+
+		for k, v := range fragment.Metadata.Labels {
+			vpcLabels[k] = v
+		}
+		if len(fragment.Metadata.Annotations) > 0 {
+			vpc.SetAnnotations(fragment.Metadata.Annotations)
+		}
+		if fragment.Spec != nil {
+			vpc.Object["spec"] = fragment.Spec
+		}
+	}
+	for k, v := range label {
+		vpcLabels[k] = v
+	}
+	vpc.SetLabels(vpcLabels)
+	return vpc, nil
+}
+
+// 模板没有设置sdn要求的字段时返回字段的路径
+func missingVpcField(backend sdnBackend, vpc *unstructured.Unstructured) string {
+	requirer, ok := backend.(vpcFieldsRequirer)
+	if !ok {
+		return ""
+	}
+	for _, field := range requirer.requiredVpcFields() {
+		value, found, _ := unstructured.NestedFieldNoCopy(vpc.Object, strings.Split(field, ".")...)
+		if !found || value == nil || value == "" {
+			return field
+		}
+	}
+	return ""
+}
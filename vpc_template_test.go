@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestRenderVpc(t *testing.T) {
+	templates, err := loadVpcTemplates(filepath.Join("testdata", "templates", "vpc-templates.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	label := map[string]string{"kubesphere.io/cluster": "poc", "kubesphere.io/workspace": "ws"}
+
+	cases := []struct {
+		name string
+		data vpcTemplateData
+		spec map[string]interface{}
+	}{
+		{
+			name: "no template",
+			data: vpcTemplateData{Name: "k8s-poc-ws", Workspace: "ws", Cluster: "poc"},
+		},
+		{
+			name: "workspace labels",
+			data: vpcTemplateData{
+				Name:        "k8s-poc-ws",
+				Workspace:   "ws",
+				Labels:      map[string]string{"network.cmft/zone": "finance"},
+				Annotations: map[string]string{"network.cmft/cidr": "10.40.0.0/16"},
+			},
+			spec: map[string]interface{}{"cidr": "10.40.0.0/16"},
+		},
+		{
+			name: "workspace annotations",
+			data: vpcTemplateData{Name: "k8s-poc-ws", Workspace: "ws", Annotations: map[string]string{"network.cmft/dmz": "true"}},
+			spec: map[string]interface{}{"natGateway": true},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vpc, err := renderVpc(yunshanBackend{}, templates, c.data, label)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if vpc.GetName() != c.data.Name || !reflect.DeepEqual(vpc.GetLabels(), label) {
+				t.Errorf("unexpected metadata %v %v", vpc.GetName(), vpc.GetLabels())
+			}
+			spec, _ := vpc.Object["spec"].(map[string]interface{})
+			if !reflect.DeepEqual(spec, c.spec) {
+				t.Errorf("got spec %v, want %v", spec, c.spec)
+			}
+		})
+	}
+}
+
+func TestLoadVpcTemplatesRejectsInvalid(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"unknown-field.yaml": "templates:\n- name: a\n  workspace: [a]\n  template: 'spec: {}'\n",
+		"no-name.yaml":       "templates:\n- template: 'spec: {}'\n",
+		"bad-template.yaml":  "templates:\n- name: a\n  template: '{{ .Workspace '\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadVpcTemplates(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// 渲染结果只能包含metadata的label、annotation和spec
+	path := filepath.Join(dir, "name.yaml")
+	if err := os.WriteFile(path, []byte("templates:\n- name: a\n  template: |\n    metadata:\n      name: other\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	templates, err := loadVpcTemplates(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := renderVpc(yunshanBackend{}, templates, vpcTemplateData{Name: "vpc"}, nil); err == nil {
+		t.Error("expected an error for a template setting metadata.name")
+	}
+}
+
+func TestWorkspaceCreateUsesVpcTemplate(t *testing.T) {
+	whsvr, fakeClient := newTestServer(t, "k8s-poc")
+	templates, err := loadVpcTemplates(filepath.Join("testdata", "templates", "vpc-templates.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	whsvr.vpcTemplates = templates
+
+	body, err := os.ReadFile(filepath.Join("testdata", "requests", "workspace-create.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := toGolden(t, admit(t, whsvr, body), nil); !got.Allowed {
+		t.Fatalf("denied: %s", got.Message)
+	}
+
+	vpc, err := fakeClient.Resource(vpcGVR).Get(context.TODO(), "k8s-poc-leo-test", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLabels := map[string]string{
+		"kubesphere.io/cluster":   "poc",
+		"kubesphere.io/workspace": "leo-test",
+		"network.cmft/tier":       "test",
+	}
+	if !reflect.DeepEqual(vpc.GetLabels(), wantLabels) {
+		t.Errorf("got labels %v, want %v", vpc.GetLabels(), wantLabels)
+	}
+	if got := vpc.GetAnnotations()["nci.yunshan.net/description"]; got != "vpc of leo-test in poc" {
+		t.Errorf("unexpected annotation %q", got)
+	}
+	if cidr, _, _ := unstructured.NestedString(vpc.Object, "spec", "cidr"); cidr != "10.30.0.0/16" {
+		t.Errorf("unexpected cidr %q", cidr)
+	}
+}
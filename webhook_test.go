@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// 写入golden文件的准入结果，patch解码后保存便于review
+type goldenResult struct {
+	APIVersion  string          `json:"apiVersion"`
+	UID         string          `json:"uid"`
+	Allowed     bool            `json:"allowed"`
+	Code        int32           `json:"code,omitempty"`
+	Reason      string          `json:"reason,omitempty"`
+	Message     string          `json:"message,omitempty"`
+	Patch       json.RawMessage `json:"patch,omitempty"`
+	SideEffects []string        `json:"sideEffects,omitempty"`
+}
+
+// 从testdata/fixtures以及额外的清单构造假的集群
+func newTestServer(t *testing.T, vpcprefix string, extraFixtures ...string) (*WebhookServer, *dynamicfake.FakeDynamicClient) {
+	t.Helper()
+
+	fixtures, err := loadFixtures(append([]string{filepath.Join("testdata", "fixtures")}, extraFixtures...))
+	if err != nil {
+		t.Fatalf("load fixtures: %v", err)
+	}
+	fakeClient, err := newFakeClient(fixtures)
+	if err != nil {
+		t.Fatalf("new fake client: %v", err)
+	}
+
+	return &WebhookServer{
+		vpcprefix:  vpcprefix,
+		abnormalws: sliceFlag{"shanglv", "midcloud", "bigdata-usercenter2"},
+		cluster:    "poc",
+		locale:     localeZh,
+		features:   allFeatures,
+		client:     Client{dynamicClient: fakeClient},
+		timeout:    10 * time.Second,
+		vpcOverride: vpcOverridePolicy{
+			adminGroups: sliceFlag{"platform-admins"},
+			vpcs:        sliceFlag{"shanglv"},
+		},
+	}, fakeClient
+}
+
+// 通过httptest把请求发送给serve，与apiserver调用webhook的方式一致
+func admit(t *testing.T, whsvr *WebhookServer, body []byte) map[string]interface{} {
+	t.Helper()
+	return admitPath(t, whsvr, "/mutate", body)
+}
+
+func admitPath(t *testing.T, whsvr *WebhookServer, path string, body []byte) map[string]interface{} {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	whsvr.registerRoutes(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	var review map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&review); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	return review
+}
+
+func toGolden(t *testing.T, review map[string]interface{}, effects []string) goldenResult {
+	t.Helper()
+
+	data, err := json.Marshal(review["response"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response struct {
+		UID     string `json:"uid"`
+		Allowed bool   `json:"allowed"`
+		Status  *struct {
+			Code    int32  `json:"code"`
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"status"`
+		Patch []byte `json:"patch"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		t.Fatal(err)
+	}
+
+	result := goldenResult{
+		APIVersion:  review["apiVersion"].(string),
+		UID:         response.UID,
+		Allowed:     response.Allowed,
+		Patch:       response.Patch,
+		SideEffects: effects,
+	}
+	if response.Status != nil {
+		result.Code, result.Reason, result.Message = response.Status.Code, response.Status.Reason, response.Status.Message
+	}
+	return result
+}
+
+func TestServeGolden(t *testing.T) {
+	cases := []struct {
+		name      string
+		request   string
+		vpcprefix string
+		fixtures  []string
+	}{
+		{name: "namespace-default-prefix", request: "namespace-prefixed", vpcprefix: "default"},
+		{name: "namespace-system-workspace", request: "namespace-system-workspace"},
+		{name: "namespace-firefly", request: "namespace-firefly"},
+		{name: "namespace-prefixed", request: "namespace-prefixed"},
+		{name: "namespace-abnormal-midcloud", request: "namespace-abnormal-midcloud"},
+		{name: "namespace-abnormal-bigdata", request: "namespace-abnormal-bigdata"},
+		{name: "namespace-abnormal-shanglv", request: "namespace-abnormal-shanglv"},
+		{name: "namespace-label-present", request: "namespace-label-present"},
+		{name: "namespace-opt-out", request: "namespace-opt-out"},
+		{name: "namespace-no-workspace", request: "namespace-no-workspace"},
+		{name: "namespace-workspace-missing", request: "namespace-workspace-missing"},
+		{name: "namespace-v1beta1", request: "namespace-v1beta1"},
+		{name: "namespace-vpc-override", request: "namespace-vpc-override"},
+		{name: "namespace-vpc-override-forbidden", request: "namespace-vpc-override-forbidden"},
+		{name: "namespace-vpc-override-not-allowed", request: "namespace-vpc-override-not-allowed"},
+		{name: "namespace-vpc-override-unchanged", request: "namespace-vpc-override-unchanged"},
+		{name: "namespace-vpc-binding-opt-out", request: "namespace-vpc-binding-opt-out"},
+		{name: "namespace-vpc-binding-workspace", request: "namespace-vpc-binding-workspace"},
+		{name: "namespace-vpc-binding-forged", request: "namespace-vpc-binding-forged"},
+		{name: "deployment-ingress", request: "deployment-ingress"},
+		{name: "deployment-not-ingress", request: "deployment-not-ingress"},
+		{name: "deployment-no-subnet", request: "deployment-no-subnet"},
+		{name: "deployment-already-pinned", request: "deployment-already-pinned"},
+		{name: "daemonset-ingress", request: "daemonset-ingress"},
+		{name: "replicaset-ingress", request: "replicaset-ingress"},
+		{name: "replicaset-owned", request: "replicaset-owned"},
+		{name: "pod-ingress", request: "pod-ingress"},
+		{name: "pod-owned", request: "pod-owned"},
+		{name: "workspace-create", request: "workspace-create"},
+		{name: "workspace-create-default-prefix", request: "workspace-create", vpcprefix: "default"},
+		{name: "workspace-create-abnormal", request: "workspace-create-abnormal"},
+		{name: "workspace-create-vpc-exists", request: "workspace-create-vpc-exists"},
+		{name: "workspace-delete", request: "workspace-delete"},
+		{name: "workspace-delete-vpc-missing", request: "workspace-delete-vpc-missing"},
+		{name: "unsupported-kind", request: "unsupported-kind"},
+		{name: "policy-vpc-label-exempt", request: "namespace-prefixed", fixtures: []string{"testdata/policies"}},
+		{name: "policy-vpc-label-default", request: "namespace-abnormal-midcloud", fixtures: []string{"testdata/policies"}},
+		{name: "policy-vpc-label-forged", request: "namespace-vpc-binding-forged", fixtures: []string{"testdata/policies"}},
+		{name: "policy-fixed-ips-off", request: "deployment-ingress", fixtures: []string{"testdata/policies"}},
+		{name: "policy-vpc-lifecycle-exempt", request: "workspace-create", fixtures: []string{"testdata/policies"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vpcprefix := c.vpcprefix
+			if vpcprefix == "" {
+				vpcprefix = "k8s-poc"
+			}
+			whsvr, fakeClient := newTestServer(t, vpcprefix, c.fixtures...)
+
+			body, err := os.ReadFile(filepath.Join("testdata", "requests", c.request+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := toGolden(t, admit(t, whsvr, body), sideEffects(fakeClient.Actions()))
+			gotBytes, err := json.MarshalIndent(got, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotBytes = append(gotBytes, '\n')
+
+			goldenPath := filepath.Join("testdata", "golden", c.name+".json")
+			if *update {
+				if err := os.WriteFile(goldenPath, gotBytes, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("read golden file (run with -update to create it): %v", err)
+			}
+			if !bytes.Equal(want, gotBytes) {
+				t.Errorf("response mismatch for %s\n--- want\n%s\n--- got\n%s", c.name, want, gotBytes)
+			}
+		})
+	}
+}
+
+func TestServeRejectsBadRequests(t *testing.T) {
+	whsvr, _ := newTestServer(t, "k8s-poc")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mutate", whsvr.serve)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	body, err := os.ReadFile(filepath.Join("testdata", "requests", "namespace-prefixed.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name        string
+		method      string
+		contentType string
+		body        []byte
+		want        int
+	}{
+		{name: "method", method: http.MethodGet, contentType: "application/json", body: body, want: http.StatusMethodNotAllowed},
+		{name: "empty body", method: http.MethodPost, contentType: "application/json", want: http.StatusBadRequest},
+		{name: "content type", method: http.MethodPost, contentType: "text/plain", body: body, want: http.StatusUnsupportedMediaType},
+		{name: "no request", method: http.MethodPost, contentType: "application/json", body: []byte(`{"kind":"AdmissionReview","apiVersion":"admission.k8s.io/v1"}`), want: http.StatusBadRequest},
+		{name: "too large", method: http.MethodPost, contentType: "application/json", body: bytes.Repeat([]byte(" "), maxAdmissionReviewBytes+1), want: http.StatusRequestEntityTooLarge},
+		{name: "not json", method: http.MethodPost, contentType: "application/json", body: []byte("{"), want: http.StatusBadRequest},
+		{name: "charset", method: http.MethodPost, contentType: "application/json; charset=utf-8", body: body, want: http.StatusOK},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req, err := http.NewRequest(c.method, server.URL+"/mutate", bytes.NewReader(c.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", c.contentType)
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != c.want {
+				t.Errorf("got status %d, want %d", resp.StatusCode, c.want)
+			}
+		})
+	}
+}
+
+// 单个请求的耗时和内存分配，go test -bench Serve -run ^$
+func BenchmarkServe(b *testing.B) {
+	for _, name := range []string{"namespace-prefixed", "namespace-v1beta1", "deployment-ingress", "unsupported-kind"} {
+		body, err := os.ReadFile(filepath.Join("testdata", "requests", name+".json"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(name, func(b *testing.B) {
+			fixtures, err := loadFixtures([]string{filepath.Join("testdata", "fixtures")})
+			if err != nil {
+				b.Fatal(err)
+			}
+			fakeClient, err := newFakeClient(fixtures)
+			if err != nil {
+				b.Fatal(err)
+			}
+			whsvr := &WebhookServer{
+				vpcprefix:  "k8s-poc",
+				abnormalws: sliceFlag{"shanglv", "midcloud", "bigdata-usercenter2"},
+				cluster:    "poc",
+				locale:     localeZh,
+				features:   allFeatures,
+				client:     Client{dynamicClient: fakeClient},
+			}
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				rec := httptest.NewRecorder()
+				whsvr.serve(rec, req)
+				if rec.Code != http.StatusOK {
+					b.Fatalf("status %d", rec.Code)
+				}
+			}
+		})
+	}
+}
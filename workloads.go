@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	rolloutGVR             = schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"}
+	cloneSetGVR            = schema.GroupVersionResource{Group: "apps.kruise.io", Version: "v1alpha1", Resource: "clonesets"}
+	advancedStatefulSetGVR = schema.GroupVersionResource{Group: "apps.kruise.io", Version: "v1beta1", Resource: "statefulsets"}
+)
+
+// 通过unstructured访问pod模板的CRD工作负载，模板都在spec.template
+var templateWorkloads = map[schema.GroupKind]schema.GroupVersionResource{
+	{Group: rolloutGVR.Group, Kind: "Rollout"}:                 rolloutGVR,
+	{Group: cloneSetGVR.Group, Kind: "CloneSet"}:               cloneSetGVR,
+	{Group: advancedStatefulSetGVR.Group, Kind: "StatefulSet"}: advancedStatefulSetGVR,
+}
+
+// Argo Rollouts发布时附加到canary/stable、preview/active pod上的metadata
+var rolloutEphemeralMetadata = [][]string{
+	{"spec", "strategy", "canary", "canaryMetadata"},
+	{"spec", "strategy", "canary", "stableMetadata"},
+	{"spec", "strategy", "blueGreen", "previewMetadata"},
+	{"spec", "strategy", "blueGreen", "activeMetadata"},
+}
+
+// 会覆盖pod annotations的metadata，path为其annotations的patch路径
+type annotationOverride struct {
+	path        string
+	annotations map[string]string
+}
+
+// 覆盖中设置了其他固定ip时改回子网的地址，没有设置时不修改
+func (o annotationOverride) pin(key, ips string) []patchOperation {
+	value, ok := o.annotations[key]
+	if !ok || value == ips {
+		return nil
+	}
+	glog.Infof("Pinning %s at %s to the reserved fixed ips", key, o.path)
+	return []patchOperation{{Op: "replace", Path: o.path + "/" + escapeJSONPointer(key), Value: ips}}
+}
+
+func escapeJSONPointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
+
+// Argo Rollouts、OpenKruise CloneSet和Advanced StatefulSet
+func mutateTemplateWorkload(svmate serverMate, obj *unstructured.Unstructured) *v1.AdmissionResponse {
+	objectMeta := metav1.ObjectMeta{
+		Name:        obj.GetName(),
+		Namespace:   obj.GetNamespace(),
+		Labels:      obj.GetLabels(),
+		Annotations: obj.GetAnnotations(),
+	}
+
+	// Rollout通过workloadRef引用Deployment时没有模板，由Deployment的处理器在其模板中注入
+	if _, found, _ := unstructured.NestedMap(obj.Object, "spec", "template"); !found {
+		glog.Infof("%s %s has no pod template, skipping", obj.GetKind(), obj.GetName())
+		return &v1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+	labels, _, _ := unstructured.NestedStringMap(obj.Object, "spec", "template", "metadata", "labels")
+	annotations, _, _ := unstructured.NestedStringMap(obj.Object, "spec", "template", "metadata", "annotations")
+	specMeta := metav1.ObjectMeta{Labels: labels, Annotations: annotations}
+
+	var overrides []annotationOverride
+	if obj.GetKind() == "Rollout" {
+		for _, fields := range rolloutEphemeralMetadata {
+			ephemeral, found, _ := unstructured.NestedStringMap(obj.Object, append(fields, "annotations")...)
+			if found {
+				overrides = append(overrides, annotationOverride{path: "/" + strings.Join(fields, "/") + "/annotations", annotations: ephemeral})
+			}
+		}
+	}
+
+	// 三种工作负载的副本数都在spec.replicas，未设置时为1
+	replicas, found, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+	singlePod := !found || replicas <= 1
+
+	return mutateFixedIPs(svmate, obj.GetName(), obj.GetNamespace(), &objectMeta, &specMeta, templateAnnotationsPath, singlePod, overrides...)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestTemplateWorkloads(t *testing.T) {
+	whsvr, _ := newTestServer(t, "k8s-poc")
+	const ips = "10.64.88.1,10.64.88.2,10.64.88.3,10.64.88.4,10.64.88.5,10.64.88.6,10.64.88.7,10.64.88.8,10.64.88.9,10.64.88.10,10.64.88.11,10.64.88.12,10.64.88.13,10.64.88.14,10.64.88.15"
+
+	cases := []struct {
+		name     string
+		manifest string
+		patch    map[string]interface{} // path -> value，只比较字符串值
+		denied   bool
+	}{
+		{
+			name: "rollout canary",
+			manifest: `
+apiVersion: argoproj.io/v1alpha1
+kind: Rollout
+metadata:
+  name: kubesphere-router-kube-system
+  namespace: kube-system
+  labels:
+    app.kubernetes.io/component: controller
+    app.kubernetes.io/name: ingress-nginx
+spec:
+  strategy:
+    canary:
+      canaryMetadata:
+        annotations:
+          nci.yunshan.net/ips: 10.64.90.1
+      stableMetadata:
+        labels:
+          role: stable
+  template:
+    metadata:
+      labels:
+        app: kubesphere-router-kube-system
+`,
+			patch: map[string]interface{}{
+				"/spec/template/metadata/annotations":                                   nil,
+				"/spec/strategy/canary/canaryMetadata/annotations/nci.yunshan.net~1ips": ips,
+			},
+		},
+		{
+			name: "rollout blue-green pinned",
+			manifest: `
+apiVersion: argoproj.io/v1alpha1
+kind: Rollout
+metadata:
+  name: kubesphere-router-kube-system
+  namespace: kube-system
+  labels:
+    app.kubernetes.io/component: controller
+    app.kubernetes.io/name: ingress-nginx
+spec:
+  strategy:
+    blueGreen:
+      previewMetadata:
+        annotations:
+          nci.yunshan.net/ips: ` + ips + `
+  template:
+    metadata:
+      annotations:
+        nci.yunshan.net/ips: ` + ips + `
+`,
+			patch: map[string]interface{}{},
+		},
+		{
+			name: "rollout workloadRef",
+			manifest: `
+apiVersion: argoproj.io/v1alpha1
+kind: Rollout
+metadata:
+  name: kubesphere-router-kube-system
+  namespace: kube-system
+  labels:
+    app.kubernetes.io/component: controller
+    app.kubernetes.io/name: ingress-nginx
+spec:
+  workloadRef:
+    apiVersion: apps/v1
+    kind: Deployment
+    name: kubesphere-router-kube-system
+`,
+			patch: map[string]interface{}{},
+		},
+		{
+			name: "cloneset",
+			manifest: `
+apiVersion: apps.kruise.io/v1alpha1
+kind: CloneSet
+metadata:
+  name: kubesphere-router-kube-system
+  namespace: kube-system
+  labels:
+    app.kubernetes.io/component: controller
+    app.kubernetes.io/name: ingress-nginx
+spec:
+  template:
+    metadata:
+      labels:
+        app: kubesphere-router-kube-system
+`,
+			patch: map[string]interface{}{"/spec/template/metadata/annotations": nil},
+		},
+		{
+			name: "advanced statefulset",
+			manifest: `
+apiVersion: apps.kruise.io/v1beta1
+kind: StatefulSet
+metadata:
+  name: kubesphere-router-kube-system
+  namespace: kube-system
+  labels:
+    app.kubernetes.io/component: controller
+    app.kubernetes.io/name: ingress-nginx
+spec:
+  template:
+    metadata:
+      labels:
+        app: kubesphere-router-kube-system
+`,
+			patch: map[string]interface{}{"/spec/template/metadata/annotations": nil},
+		},
+		{
+			name: "apps statefulset",
+			manifest: `
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: kubesphere-router-kube-system
+  namespace: kube-system
+`,
+			denied: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ar, err := simulatedReview([]byte(c.manifest), "CREATE")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp := whsvr.mutate(context.Background(), ar, localeEn)
+			if resp.Allowed == c.denied {
+				t.Fatalf("allowed %v: %v", resp.Allowed, resp.Result)
+			}
+			if c.denied {
+				return
+			}
+
+			var patch []patchOperation
+			if len(resp.Patch) > 0 {
+				if err := json.Unmarshal(resp.Patch, &patch); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(patch) != len(c.patch) {
+				t.Fatalf("patch %s", resp.Patch)
+			}
+			for _, op := range patch {
+				want, ok := c.patch[op.Path]
+				if !ok {
+					t.Errorf("unexpected operation %+v", op)
+				} else if want != nil && op.Value != want {
+					t.Errorf("%s = %v, want %v", op.Path, op.Value, want)
+				}
+			}
+		})
+	}
+}